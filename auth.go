@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	tokenFileName   = "auth_token"
+	tokenCookieName = "zealcore_token"
+	// context key of the token taken from the query by takeQueryToken
+	queryTokenKey = "zealcore.queryToken"
+)
+
+// loadToken reads the API token from the data dir, generating it on first run.
+func loadToken(dataDir string) (string, error) {
+	path := filepath.Join(dataDir, tokenFileName)
+	if data, err := ioutil.ReadFile(path); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(token + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return token, nil
+}
+
+// accessPolicy guards the API against other local users (with the token) and
+// against web pages, which can reach localhost through DNS rebinding (caught
+// by the Host check) or cross-origin requests (caught by the Origin check).
+type accessPolicy struct {
+	token   string // empty if no token is required
+	hosts   map[string]bool
+	origins map[string]bool
+}
+
+func newAccessPolicy(cfg config) (*accessPolicy, error) {
+	p := &accessPolicy{"", make(map[string]bool), make(map[string]bool)}
+	if cfg.Auth {
+		var err error
+		if p.token, err = loadToken(cfg.DataDir); err != nil {
+			return nil, err
+		}
+	}
+
+	hosts := cfg.AllowedHosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if host, _, err := net.SplitHostPort(cfg.Listen); err == nil && host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	for _, host := range hosts {
+		p.hosts[strings.ToLower(host)] = true
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		p.origins[strings.ToLower(origin)] = true
+	}
+	return p, nil
+}
+
+func (p *accessPolicy) hostAllowed(hostport string) bool {
+	if p.hosts["*"] {
+		return true
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport // no port
+	}
+	return p.hosts[strings.ToLower(strings.Trim(host, "[]"))]
+}
+
+func (p *accessPolicy) originAllowed(origin string) bool {
+	if p.origins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // including the "null" origin of sandboxed pages
+	}
+	return p.hostAllowed(u.Host)
+}
+
+// takeQueryToken removes the token query parameter before requests are
+// logged, keeping it in the context for tokenValid.
+func takeQueryToken(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if _, ok := query["token"]; ok {
+		c.Set(queryTokenKey, query.Get("token"))
+		query.Del("token")
+		c.Request.URL.RawQuery = query.Encode()
+	}
+	c.Next()
+}
+
+// tokenValid checks the token of the request.  The query parameter ends up in
+// browser histories and Referer headers, so it's only accepted by /auth and
+// for websockets, whose clients can set neither headers nor, from another
+// origin, the cookie.
+func (p *accessPolicy) tokenValid(c *gin.Context) bool {
+	r := c.Request
+	var token string
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = auth[len("Bearer "):]
+	} else if cookie, err := r.Cookie(tokenCookieName); err == nil {
+		token = cookie.Value
+	} else if r.URL.Path == "/auth" || isWebsocket(r) {
+		value, _ := c.Get(queryTokenKey)
+		token, _ = value.(string)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) == 1
+}
+
+func viaUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+func isWebsocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// middleware rejects requests with unexpected Host headers, websockets and
+// state changing requests from other origins, and requests without the
+// token if one is required.
+func (p *accessPolicy) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r := c.Request
+		// access to unix sockets is already limited by file permissions, and
+		// clients set arbitrary Host headers for them
+		if !viaUnixSocket(r) {
+			if !p.hostAllowed(r.Host) {
+				c.AbortWithStatus(403)
+				return
+			}
+			origin := r.Header.Get("Origin")
+			checkOrigin := isWebsocket(r) || r.Method != "GET" && r.Method != "HEAD"
+			if origin != "" && checkOrigin && !p.originAllowed(origin) {
+				c.AbortWithStatus(403)
+				return
+			}
+		}
+		if p.token != "" && !p.tokenValid(c) {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatus(401)
+			return
+		}
+		c.Next()
+	}
+}
+
+// login stores the token passed in the query in a cookie, so that browsers
+// can use the API after opening /auth?token=... once.
+func (p *accessPolicy) login(c *gin.Context) {
+	if p.token != "" {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     tokenCookieName,
+			Value:    p.token,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	c.Data(204, "", []byte(""))
+}
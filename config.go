@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kyoh86/xdg"
+
+	"github.com/zealdocs/zealcore/zealindex"
+)
+
+// config is read from a JSON file, then overridden by ZEALCORE_* environment
+// variables and finally by command line flags.
+type config struct {
+	DataDir  string   // where docsets and the cache DB are stored
+	Listen   string   // TCP address to serve on, like "127.0.0.1:12340"
+	Socket   string   // path of a unix socket to serve on instead of TCP, or "auto"
+	Repos    []string // names of enabled repos, all if empty
+	Feeds    zealindex.FeedURLs
+	FullText bool // build full-text indices of installed docsets
+	// index trigrams of symbol names to speed up searches, at the cost of
+	// memory
+	TrigramIndex bool
+	// require the token from <DataDir>/auth_token with every request
+	Auth bool
+	// allowed values of the Host header, localhost and the Listen host if
+	// empty, "*" to allow any
+	AllowedHosts []string
+	// origins allowed besides ones with an allowed host, like "https://example.com"
+	AllowedOrigins []string
+	MaxJobs        int // installs and updates running at once
+	// how often feeds are checked for docset updates, like "24h", or "0" to
+	// only check on demand
+	UpdateInterval string
+	// how long fetched docset lists are used before being fetched again,
+	// or "0" to only fetch them again on demand
+	FeedTTL string
+}
+
+func defaultConfig() config {
+	return config{
+		DataDir: filepath.Join(xdg.DataHome(), "zealcore"),
+		Listen:  "127.0.0.1:12340",
+		Feeds:   zealindex.DefaultFeeds,
+		MaxJobs: 2,
+
+		TrigramIndex:   true,
+		UpdateInterval: "24h",
+		FeedTTL:        "24h",
+	}
+}
+
+func defaultConfigPath() string {
+	return filepath.Join(xdg.ConfigHome(), "zealcore", "config.json")
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// loadFile overrides cfg with the fields set in the JSON file at path.  A
+// missing file is only an error if required is set.
+func (cfg *config) loadFile(path string, required bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	return nil
+}
+
+func (cfg *config) loadEnv() {
+	if v := os.Getenv("ZEALCORE_DATA_DIR"); v != "" {
+		cfg.DataDir = v
+	}
+	if v := os.Getenv("ZEALCORE_LISTEN"); v != "" {
+		cfg.Listen = v
+	}
+	if v := os.Getenv("ZEALCORE_SOCKET"); v != "" {
+		cfg.Socket = v
+	}
+	if v := os.Getenv("ZEALCORE_REPOS"); v != "" {
+		cfg.Repos = splitList(v)
+	}
+	if v := os.Getenv("ZEALCORE_DASH_FEED"); v != "" {
+		cfg.Feeds.Dash = v
+	}
+	if v := os.Getenv("ZEALCORE_DASH_DOWNLOAD"); v != "" {
+		cfg.Feeds.DashDownload = v
+	}
+	if v := os.Getenv("ZEALCORE_DASH_MIRRORS"); v != "" {
+		cfg.Feeds.DashMirrors = splitList(v)
+	}
+	if v := os.Getenv("ZEALCORE_CONTRIB_MIRRORS"); v != "" {
+		cfg.Feeds.Contrib = splitList(v)
+	}
+	if v := os.Getenv("ZEALCORE_FULLTEXT"); v != "" {
+		cfg.FullText = v == "1" || v == "true"
+	}
+	if v := os.Getenv("ZEALCORE_TRIGRAM_INDEX"); v != "" {
+		cfg.TrigramIndex = v == "1" || v == "true"
+	}
+	if v := os.Getenv("ZEALCORE_AUTH"); v != "" {
+		cfg.Auth = v == "1" || v == "true"
+	}
+	if v := os.Getenv("ZEALCORE_ALLOWED_HOSTS"); v != "" {
+		cfg.AllowedHosts = splitList(v)
+	}
+	if v := os.Getenv("ZEALCORE_ALLOWED_ORIGINS"); v != "" {
+		cfg.AllowedOrigins = splitList(v)
+	}
+	if v := os.Getenv("ZEALCORE_MAX_JOBS"); v != "" {
+		cfg.MaxJobs, _ = strconv.Atoi(v)
+	}
+	if v := os.Getenv("ZEALCORE_UPDATE_INTERVAL"); v != "" {
+		cfg.UpdateInterval = v
+	}
+	if v := os.Getenv("ZEALCORE_FEED_TTL"); v != "" {
+		cfg.FeedTTL = v
+	}
+}
+
+// loadConfig builds the configuration from the config file, environment and
+// the given command line arguments.
+func loadConfig(args []string) (config, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("zealcore", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path of the JSON config file (default "+defaultConfigPath()+")")
+	dataDir := flags.String("data-dir", "", "directory to store docsets in")
+	listen := flags.String("listen", "", "TCP address to serve on")
+	socket := flags.String("socket", "", "path of a unix socket to serve on instead of TCP, \"auto\" for $XDG_RUNTIME_DIR/zealcore.sock")
+	repos := flags.String("repos", "", "comma-separated names of repos to enable")
+	dashFeed := flags.String("dash-feed", "", "URL of the list of Dash docsets")
+	dashDownload := flags.String("dash-download", "", "URL prefix of Dash docset archives")
+	dashMirrors := flags.String("dash-mirrors", "", "comma-separated URLs of Kapeli mirrors of Dash docset archives, tried if -dash-download fails")
+	contribMirrors := flags.String("contrib-mirrors", "", "comma-separated URLs of user contributed docset mirrors")
+	fullText := flags.Bool("fulltext", false, "build full-text indices of installed docsets")
+	trigramIndex := flags.Bool("trigram-index", true, "index trigrams of symbol names to speed up searches")
+	auth := flags.Bool("auth", false, "require the token stored in the data dir with every request")
+	allowedHosts := flags.String("allowed-hosts", "", "comma-separated allowed Host headers, \"*\" for any")
+	allowedOrigins := flags.String("allowed-origins", "", "comma-separated additional allowed origins")
+	maxJobs := flags.Int("max-jobs", 0, "number of installs and updates running at once (default 2)")
+	updateInterval := flags.String("update-interval", "", "how often to check feeds for docset updates, \"0\" to disable (default 24h)")
+	feedTTL := flags.String("feed-ttl", "", "how long docset lists are used before being fetched again, \"0\" for no expiry (default 24h)")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	var err error
+	if *configPath != "" {
+		err = cfg.loadFile(*configPath, true)
+	} else if v := os.Getenv("ZEALCORE_CONFIG"); v != "" {
+		err = cfg.loadFile(v, true)
+	} else {
+		err = cfg.loadFile(defaultConfigPath(), false)
+	}
+	if err != nil {
+		return cfg, err
+	}
+	cfg.loadEnv()
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "listen":
+			cfg.Listen = *listen
+		case "socket":
+			cfg.Socket = *socket
+		case "repos":
+			cfg.Repos = splitList(*repos)
+		case "dash-feed":
+			cfg.Feeds.Dash = *dashFeed
+		case "dash-download":
+			cfg.Feeds.DashDownload = *dashDownload
+		case "dash-mirrors":
+			cfg.Feeds.DashMirrors = splitList(*dashMirrors)
+		case "contrib-mirrors":
+			cfg.Feeds.Contrib = splitList(*contribMirrors)
+		case "fulltext":
+			cfg.FullText = *fullText
+		case "trigram-index":
+			cfg.TrigramIndex = *trigramIndex
+		case "auth":
+			cfg.Auth = *auth
+		case "allowed-hosts":
+			cfg.AllowedHosts = splitList(*allowedHosts)
+		case "allowed-origins":
+			cfg.AllowedOrigins = splitList(*allowedOrigins)
+		case "max-jobs":
+			cfg.MaxJobs = *maxJobs
+		case "update-interval":
+			cfg.UpdateInterval = *updateInterval
+		case "feed-ttl":
+			cfg.FeedTTL = *feedTTL
+		}
+	})
+
+	if len(cfg.Feeds.Contrib) == 0 {
+		return cfg, errors.New("no contrib mirrors configured")
+	}
+	if cfg.MaxJobs < 1 {
+		return cfg, errors.New("max-jobs must be at least 1")
+	}
+	if _, err = cfg.updateInterval(); err != nil {
+		return cfg, err
+	}
+	if _, err = cfg.feedTTL(); err != nil {
+		return cfg, err
+	}
+	cfg.DataDir, err = filepath.Abs(cfg.DataDir)
+	return cfg, err
+}
+
+// repoEnabled checks whether the repo with the given name should be used.
+func (cfg config) repoEnabled(name string) bool {
+	if len(cfg.Repos) == 0 {
+		return true
+	}
+	for _, repo := range cfg.Repos {
+		if repo == name {
+			return true
+		}
+	}
+	return false
+}
+
+// updateInterval parses UpdateInterval, returning 0 if updates are only
+// checked on demand.
+func (cfg config) updateInterval() (time.Duration, error) {
+	return parseDuration("update interval", cfg.UpdateInterval)
+}
+
+// feedTTL parses FeedTTL, returning 0 if feeds only expire on demand.
+func (cfg config) feedTTL() (time.Duration, error) {
+	return parseDuration("feed TTL", cfg.FeedTTL)
+}
+
+// parseDuration parses durations like "24h", with "0" or empty meaning 0.
+func parseDuration(what, s string) (time.Duration, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid " + what + ": " + s)
+	}
+	return d, nil
+}
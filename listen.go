@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/kyoh86/xdg"
+)
+
+// Passing "auto" as the socket path puts the socket in $XDG_RUNTIME_DIR.
+const autoSocket = "auto"
+
+// first file descriptor passed by systemd, see sd_listen_fds(3)
+const systemdFirstFd = 3
+
+// systemdListener returns the listener passed with systemd socket activation,
+// or nil if there's none.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		return nil, errors.New("expected a single socket from systemd, got " + strconv.Itoa(fds))
+	}
+	// not inherited by processes started by zealcore
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdFirstFd, "LISTEN_FD_"+strconv.Itoa(systemdFirstFd))
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+func socketPath(cfg config) (string, error) {
+	if cfg.Socket != autoSocket {
+		return cfg.Socket, nil
+	}
+	if xdg.RuntimeDir() == "" {
+		return "", errors.New("XDG_RUNTIME_DIR is not set")
+	}
+	return filepath.Join(xdg.RuntimeDir(), "zealcore.sock"), nil
+}
+
+// listenUnix creates a socket only accessible by the current user, replacing
+// a stale one left behind by a previous instance.
+func listenUnix(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New(path + " is already in use")
+	}
+	if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// created according to umask, so restrict it while creating the socket
+	// instead of chmod'ing it afterwards, when others could already connect.
+	// The umask is process-wide, but files created meanwhile only end up
+	// accessible by fewer users.
+	oldUmask := syscall.Umask(0077)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(oldUmask)
+	return l, err
+}
+
+// listen returns the listener to serve on: a socket passed by systemd, else
+// the configured unix socket, else the TCP address.
+func listen(cfg config) (net.Listener, error) {
+	if l, err := systemdListener(); l != nil || err != nil {
+		return l, err
+	}
+	if cfg.Socket != "" {
+		path, err := socketPath(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return listenUnix(path)
+	}
+	return net.Listen("tcp", cfg.Listen)
+}
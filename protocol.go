@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/zealdocs/zealcore/zealindex"
+)
+
+// Version of the JSON search protocol spoken over the /search websockets,
+// see apidocs/zealcore.apib.  Clients sending plain text instead of a JSON
+// object get the legacy protocol.
+const searchProtocolVersion = 1
+
+type searchRequest struct {
+	Version  int      `json:"version"`
+	Id       string   `json:"id"`
+	Query    string   `json:"query"`
+	Docsets  []string `json:"docsets,omitempty"`
+	Types    []string `json:"types,omitempty"`
+	Limit    int      `json:"limit,omitempty"`
+	Collapse bool     `json:"collapse,omitempty"`
+	Mode     string   `json:"mode,omitempty"` // "symbols" (default) or "fulltext"
+}
+
+type searchFrame struct {
+	Version  int                       `json:"version"`
+	Type     string                    `json:"type"` // "result", "page", "done" or "error"
+	Id       string                    `json:"id"`
+	Result   *zealindex.Result         `json:"result,omitempty"`
+	Page     *zealindex.FullTextResult `json:"page,omitempty"`
+	Count    int                       `json:"count,omitempty"`
+	Total    int                       `json:"total,omitempty"`
+	Duration float64                   `json:"duration,omitempty"` // in seconds
+	Error    string                    `json:"error,omitempty"`
+}
+
+func (r searchRequest) toQuery(index *zealindex.GlobalIndex) zealindex.Query {
+	query := zealindex.ParseQuery(r.Query, index.Snapshot().HasDocset)
+	for _, ds := range r.Docsets {
+		query.Docsets = append(query.Docsets, strings.ToLower(ds))
+	}
+	for _, tp := range r.Types {
+		query.Types = append(query.Types, zealindex.MapType(tp))
+	}
+	if r.Limit > 0 {
+		query.Limit = r.Limit
+	}
+	query.Collapse = r.Collapse
+	return query
+}
+
+// searchFunc starts a search in the background, calling resultCb for every
+// result and timeCb once the search is done.
+type searchFunc func(query zealindex.Query, resultCb func(zealindex.Result), timeCb func(zealindex.SearchStats))
+
+// fullTextFunc starts a full-text search in the background, calling pagesCb
+// with all matching pages once it's done.
+type fullTextFunc func(query zealindex.Query, pagesCb func([]zealindex.FullTextResult, error, time.Duration))
+
+// prefixPaths makes result paths relative to the server root.
+func prefixPaths(res *zealindex.Result) {
+	res.Path = "docs/" + res.Path
+	for i := range res.Alternates {
+		res.Alternates[i].Path = "docs/" + res.Alternates[i].Path
+	}
+}
+
+func sendFrame(ws *websocket.Conn, frame searchFrame) {
+	frame.Version = searchProtocolVersion
+	websocket.JSON.Send(ws, frame)
+}
+
+func serveSearchRequest(ws *websocket.Conn, msg string, index *zealindex.GlobalIndex, search searchFunc, searchPages fullTextFunc) {
+	var req searchRequest
+	if err := json.Unmarshal([]byte(msg), &req); err != nil {
+		sendFrame(ws, searchFrame{Type: "error", Error: "invalid request: " + err.Error()})
+		return
+	}
+	if req.Version != searchProtocolVersion {
+		sendFrame(ws, searchFrame{
+			Type:  "error",
+			Id:    req.Id,
+			Error: "unsupported protocol version " + strconv.Itoa(req.Version),
+		})
+		return
+	}
+
+	query := req.toQuery(index)
+	if len(query.Invalid) > 0 {
+		sendFrame(ws, searchFrame{Type: "error", Id: req.Id, Error: "invalid directive: " + query.Invalid[0]})
+		return
+	}
+	if unknown := index.Snapshot().UnknownDocsets(query); len(unknown) > 0 {
+		sendFrame(ws, searchFrame{Type: "error", Id: req.Id, Error: "unknown docset: " + unknown[0]})
+		return
+	}
+
+	if req.Mode == "fulltext" {
+		searchPages(query, func(pages []zealindex.FullTextResult, err error, duration time.Duration) {
+			if err != nil {
+				sendFrame(ws, searchFrame{Type: "error", Id: req.Id, Error: err.Error()})
+				return
+			}
+			for i := range pages {
+				sendFrame(ws, searchFrame{Type: "page", Id: req.Id, Page: &pages[i]})
+			}
+			sendFrame(ws, searchFrame{
+				Type:     "done",
+				Id:       req.Id,
+				Count:    len(pages),
+				Total:    len(pages),
+				Duration: duration.Seconds(),
+			})
+		})
+		return
+	} else if req.Mode != "" && req.Mode != "symbols" {
+		sendFrame(ws, searchFrame{Type: "error", Id: req.Id, Error: "unsupported mode " + req.Mode})
+		return
+	}
+
+	count := 0
+	resultCb := func(res zealindex.Result) {
+		prefixPaths(&res)
+		count += 1
+		sendFrame(ws, searchFrame{Type: "result", Id: req.Id, Result: &res})
+	}
+	timeCb := func(stats zealindex.SearchStats) {
+		sendFrame(ws, searchFrame{
+			Type:     "done",
+			Id:       req.Id,
+			Count:    count,
+			Total:    stats.Total,
+			Duration: stats.Duration.Seconds(),
+		})
+	}
+
+	search(query, resultCb, timeCb)
+}
+
+func serveLegacySearchRequest(ws *websocket.Conn, msg string, index *zealindex.GlobalIndex, search searchFunc) {
+	firstRes := true
+
+	resultCb := func(res zealindex.Result) {
+		prefixPaths(&res)
+		js, err := json.Marshal(res)
+		if err != nil {
+			return
+		}
+		if firstRes {
+			ws.Write([]byte(" "))
+		}
+		firstRes = false
+		ws.Write([]byte(js))
+	}
+
+	timeCb := func(stats zealindex.SearchStats) {
+		ws.Write([]byte(strconv.Itoa(stats.QueryId) + ";" + fmt.Sprint(stats.Duration)))
+	}
+
+	search(zealindex.ParseQuery(msg, index.Snapshot().HasDocset), resultCb, timeCb)
+}
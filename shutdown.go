@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How long to wait for running requests, searches and installs on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// backgroundTasks tracks goroutines which http.Server.Shutdown doesn't know
+// about, like searches started by websocket clients.
+type backgroundTasks struct {
+	lock    sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// start registers a new task, returning false if shutdown has already begun.
+func (t *backgroundTasks) start() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *backgroundTasks) done() {
+	t.wg.Done()
+}
+
+// wait refuses new tasks and waits for running ones, returning false if ctx
+// is done first.
+func (t *backgroundTasks) wait(ctx context.Context) bool {
+	t.lock.Lock()
+	t.closing = true
+	t.lock.Unlock()
+
+	done := make(chan struct{})
+	go (func() {
+		t.wg.Wait()
+		close(done)
+	})()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+var searches backgroundTasks
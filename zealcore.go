@@ -1,35 +1,35 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/kyoh86/xdg"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/net/websocket"
+	"io"
 	"io/ioutil"
 	"mime"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/zealdocs/zealcore/zealindex"
 )
 
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
-
 type postItem struct {
-	Id string
-	Repo string
+	Id      string
+	Repo    string
+	Version string // pinned version to install, the latest one if empty
 }
 
 type docsetGroup struct {
@@ -37,62 +37,262 @@ type docsetGroup struct {
 	Icon string
 }
 
+// docsetGroupWithList adds the comma-separated list of docsets older clients
+// expect to zealindex.Group.
 type docsetGroupWithList struct {
-	Id string
-	Name string
-	Icon string
+	zealindex.Group
 	DocsList string
 }
 
-func MakeSearchServer(index *zealindex.GlobalIndex, groupId string) func(*websocket.Conn) {
-	var allowedDocs map[string]bool
+// docsetGroupChanges holds the fields to change with PATCH /group/:id.
+type docsetGroupChanges struct {
+	Name     *string
+	Icon     *string
+	Position *int
+}
+
+// Searches running longer than this are cancelled.
+const searchTimeout = 10 * time.Second
+
+// groupAllowedDocs returns the set of docset ids and keys a search in the
+// given group is limited to, or nil for "*" meaning all docsets.  Groups created before
+// docsets were validated may list names or aliases instead of ids, which are
+// resolved against the index.
+func groupAllowedDocs(index *zealindex.GlobalIndex, groupId string) (map[string]bool, bool) {
 	if groupId == "*" {
-		allowedDocs = nil
-	} else {
-		allowedDocs = make(map[string]bool)
-		q, err := zealindex.GetCacheDB().Query(
-			"SELECT docs_list FROM groups WHERE id=?", groupId,
-		)
-		check(err)
-		if q.Next() {
-			var docsList string
-			q.Scan(&docsList)
-			q.Close()
-			splitted := strings.Split(docsList, ",")
-			for i := 0; i < len(splitted); i++ {
-				allowedDocs[splitted[i]] = true
+		return nil, true
+	}
+	allowedDocs := make(map[string]bool)
+	group, err := zealindex.GetGroup(groupId)
+	if err != nil {
+		return allowedDocs, false
+	}
+	snapshot := index.Snapshot()
+	for _, docset := range group.Docsets {
+		allowedDocs[docset] = true
+		for _, ds := range snapshot.FindDocsets(docset) {
+			allowedDocs[groupMember(docset, ds)] = true
+		}
+	}
+	return allowedDocs, true
+}
+
+// groupMember is what groups store for the docset found by name: its key if
+// name selects a version, otherwise its id, standing for all versions.
+func groupMember(name string, ds zealindex.IndexedDocset) string {
+	if _, version := zealindex.SplitDocsetKey(name); version != "" {
+		return ds.Key()
+	}
+	return ds.Id
+}
+
+// resolveDocsets maps docset ids, names and aliases to ids of installed
+// docsets, or to keys if they're followed by a version, returning an error
+// for ones not matching any.
+func resolveDocsets(index *zealindex.GlobalIndex, names []string) ([]string, error) {
+	snapshot := index.Snapshot()
+	var res []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		found := snapshot.FindDocsets(name)
+		if len(found) == 0 {
+			return nil, errors.New("unknown docset: " + name)
+		}
+		for _, ds := range found {
+			if member := groupMember(name, ds); !seen[member] {
+				seen[member] = true
+				res = append(res, member)
 			}
 		}
 	}
+	return res, nil
+}
+
+// groupError responds with 404 for unknown groups and 500 for other errors.
+func groupError(c *gin.Context, err error) {
+	if err == zealindex.ErrGroupNotFound {
+		c.Data(404, "text/plain", []byte("Not found"))
+	} else {
+		c.Data(500, "text/plain", []byte(err.Error()))
+	}
+}
+
+func MakeSearchServer(index *zealindex.GlobalIndex, repos []zealindex.DocsRepo, groupId string) func(*websocket.Conn) {
+	allowedDocs, _ := groupAllowedDocs(index, groupId)
 	return func(ws *websocket.Conn) {
-		lastQuery := 0
-		searcher := zealindex.NewSearcher(index, &lastQuery)
-
-		input := make([]byte, 1024)
-		for _, err := ws.Read(input); err == nil; _, err = ws.Read(input) {
-			inStr := string(bytes.Trim(input, "\x00"))
-			input = make([]byte, 1024)
-
-			firstRes := true
-
-			resultCb := func(res zealindex.Result) {
-				res.Path = "docs/" + res.Path
-				js, err := json.Marshal(res)
-				check(err)
-				if firstRes {
-					ws.Write([]byte(" "))
+		// cancels searches still running once the websocket gets closed
+		connCtx, connCancel := context.WithCancel(context.Background())
+		defer connCancel()
+
+		queryId := 0
+		cancelLast := context.CancelFunc(func() {})
+		search := func(query zealindex.Query, resultCb func(zealindex.Result), timeCb func(zealindex.SearchStats)) {
+			// only the latest query on a connection is interesting
+			cancelLast()
+			queryId += 1
+			ctx, cancel := context.WithTimeout(connCtx, searchTimeout)
+			cancelLast = cancel
+			if !searches.start() {
+				return // shutting down
+			}
+			go (func(queryId int) {
+				defer searches.done()
+				defer cancel()
+				zealindex.SearchAllDocs(ctx, index, queryId, query, allowedDocs, resultCb, timeCb)
+			})(queryId)
+		}
+		searchPages := func(query zealindex.Query, pagesCb func([]zealindex.FullTextResult, error, time.Duration)) {
+			cancelLast()
+			queryId += 1
+			ctx, cancel := context.WithTimeout(connCtx, searchTimeout)
+			cancelLast = cancel
+			if !searches.start() {
+				return
+			}
+			go (func() {
+				defer searches.done()
+				defer cancel()
+				startTime := time.Now()
+				pages, err := searchFullText(ctx, index, repos, query, allowedDocs)
+				if ctx.Err() == nil {
+					pagesCb(pages, err, time.Since(startTime))
 				}
-				firstRes = false
-				ws.Write([]byte(js))
+			})()
+		}
+
+		var msg string
+		for err := websocket.Message.Receive(ws, &msg); err == nil; err = websocket.Message.Receive(ws, &msg) {
+			msg = strings.Trim(msg, "\x00")
+			if strings.HasPrefix(strings.TrimSpace(msg), "{") {
+				serveSearchRequest(ws, msg, index, search, searchPages)
+			} else {
+				serveLegacySearchRequest(ws, msg, index, search)
 			}
+		}
+	}
+}
+
+type searchResponse struct {
+	Total    int                        `json:"total"`
+	Offset   int                        `json:"offset"`
+	Limit    int                        `json:"limit"`
+	Duration float64                    `json:"duration"` // in seconds
+	Results  []zealindex.Result         `json:"results"`
+	Pages    []zealindex.FullTextResult `json:"pages,omitempty"`
+}
+
+// searchFullText searches the contents of pages of docsets with a full-text
+// index, returning at most query.Limit pages after skipping query.Offset.
+func searchFullText(ctx context.Context, index *zealindex.GlobalIndex, repos []zealindex.DocsRepo, query zealindex.Query, allowedDocs map[string]bool) ([]zealindex.FullTextResult, error) {
+	if len(query.Docsets) > 0 {
+		// docset prefixes are resolved against the symbol index, which also
+		// knows the docsets' keywords
+		scoped := make(map[string]bool)
+		for _, seg := range index.Snapshot().Segments {
+			if query.MatchesDocset(seg.Docset) && seg.Docset.InScope(allowedDocs) {
+				scoped[seg.Docset.Key()] = true
+			}
+		}
+		allowedDocs = scoped
+	}
+
+	var res []zealindex.FullTextResult
+	for _, repo := range repos {
+		ftRepo, ok := repo.(zealindex.FullTextRepo)
+		if !ok {
+			continue
+		}
+		pages, err := ftRepo.SearchFullText(ctx, query.Text, allowedDocs, query.Offset+query.Limit-len(res))
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			page.Path = "docs/" + page.Path
+			res = append(res, page)
+		}
+		if len(res) >= query.Offset+query.Limit {
+			break
+		}
+	}
+	if query.Offset >= len(res) {
+		return []zealindex.FullTextResult{}, nil
+	}
+	return res[query.Offset:], nil
+}
+
+// MakeRestSearchHandler serves synchronous searches for clients which can't
+// use the websockets, like `GET /api/search?q=...&group=...&offset=0&limit=20`.
+// Results with the same name and type are merged with `collapse=1`, and
+// `mode=fulltext` searches the contents of pages instead of symbols.
+func MakeRestSearchHandler(index *zealindex.GlobalIndex, repos []zealindex.DocsRepo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowedDocs, found := groupAllowedDocs(index, c.DefaultQuery("group", "*"))
+		if !found {
+			c.Data(404, "text/plain", []byte("group not found"))
+			return
+		}
 
-			timeCb := func(curQuery int, t time.Duration) {
-				ws.Write([]byte(strconv.Itoa(curQuery) + ";" + fmt.Sprint(t)))
+		query := zealindex.ParseQuery(c.Query("q"), index.Snapshot().HasDocset)
+		var err error
+		if offset := c.Query("offset"); offset != "" {
+			query.Offset, err = strconv.Atoi(offset)
+			if err != nil || query.Offset < 0 {
+				c.Data(400, "text/plain", []byte("invalid offset"))
+				return
+			}
+		}
+		if limit := c.Query("limit"); limit != "" {
+			query.Limit, err = strconv.Atoi(limit)
+			if err != nil || query.Limit <= 0 {
+				c.Data(400, "text/plain", []byte("invalid limit"))
+				return
 			}
+		}
+
+		query.Collapse = c.Query("collapse") == "1" || c.Query("collapse") == "true"
+		if len(query.Invalid) > 0 {
+			c.Data(400, "text/plain", []byte("invalid directive: "+query.Invalid[0]))
+			return
+		}
+		if unknown := index.Snapshot().UnknownDocsets(query); len(unknown) > 0 {
+			c.Data(400, "text/plain", []byte("unknown docset: "+unknown[0]))
+			return
+		}
 
+		ctx, cancel := context.WithTimeout(c.Request.Context(), searchTimeout)
+		defer cancel()
+		res := searchResponse{Offset: query.Offset, Limit: query.Limit, Results: []zealindex.Result{}}
 
-			go zealindex.SearchAllDocs(&searcher, inStr, allowedDocs, resultCb, timeCb)
+		if c.Query("mode") == "fulltext" {
+			startTime := time.Now()
+			res.Pages, err = searchFullText(ctx, index, repos, query, allowedDocs)
+			if _, invalid := err.(zealindex.FullTextQueryError); invalid {
+				c.Data(400, "text/plain", []byte(err.Error()))
+				return
+			} else if err != nil {
+				c.Data(500, "text/plain", []byte(err.Error()))
+				return
+			}
+			res.Total = len(res.Pages)
+			res.Duration = time.Since(startTime).Seconds()
+			c.JSON(200, res)
+			return
+		} else if c.Query("mode") != "" && c.Query("mode") != "symbols" {
+			c.Data(400, "text/plain", []byte("invalid mode"))
+			return
+		}
+		zealindex.SearchAllDocs(ctx, index, 1, query, allowedDocs, func(r zealindex.Result) {
+			prefixPaths(&r)
+			res.Results = append(res.Results, r)
+		}, func(stats zealindex.SearchStats) {
+			res.Total = stats.Total
+			res.Duration = stats.Duration.Seconds()
+		})
+		if ctx.Err() != nil {
+			c.Data(503, "text/plain", []byte("search cancelled: "+ctx.Err().Error()))
+			return
 		}
+		c.JSON(200, res)
 	}
 }
 
@@ -103,51 +303,211 @@ type progressReport struct {
 	Total    int64
 }
 
-func createGlobalIndex(sources []zealindex.DocsRepo) zealindex.GlobalIndex {
-	var all []string
-	var allMunged []string
-	var paths []string
-	var docsets []int
-	var types []string
-	var docsetNames [][]string
-
-	idx := zealindex.GlobalIndex{&all,
-		&allMunged,
-		&paths,
-		&docsets,
-		&types,
-		&docsetNames,
-		sync.RWMutex{}}
+// createGlobalIndex indexes the installed docsets of all repos, with
+// trigram indices if enabled.  Docsets which fail to load are reported and
+// left out.
+func createGlobalIndex(sources []zealindex.DocsRepo, trigrams bool) *zealindex.GlobalIndex {
+	idx := zealindex.NewGlobalIndex()
+	if trigrams {
+		idx.EnableTrigramIndex()
+	}
 
 	for _, source := range sources {
-		source.ImportAll(idx)
+		if err := source.ImportAll(idx); err != nil {
+			fmt.Fprintln(os.Stderr, source.Name()+": "+err.Error())
+		}
 	}
 
 	return idx
 }
 
+func dashRepo(create func() (zealindex.DashRepo, error)) func() (zealindex.DocsRepo, error) {
+	return func() (zealindex.DocsRepo, error) {
+		repo, err := create()
+		return repo, err
+	}
+}
+
+// availableRepos lists all repos by name, in the order they're searched.
+var availableRepos = []struct {
+	name   string
+	create func() (zealindex.DocsRepo, error)
+}{
+	{"com.kapeli", dashRepo(zealindex.NewDashRepo)},
+	{"com.kapeli.contrib", dashRepo(zealindex.NewDashContribRepo)},
+	{"com.kapeli.local", dashRepo(zealindex.NewDashLocalRepo)},
+	{"org.gnome", func() (zealindex.DocsRepo, error) { return zealindex.NewDocbooksRepo(), nil }},
+}
+
+// installJob returns a job running install, then indexing the installed
+// docset.
+func installJob(repo zealindex.DocsRepo, index *zealindex.GlobalIndex, id string, install func(context.Context, *zealindex.RunningJob) error) func(context.Context, *zealindex.RunningJob) error {
+	return func(ctx context.Context, job *zealindex.RunningJob) error {
+		if err := install(ctx, job); err != nil {
+			return err
+		}
+		job.SetState(zealindex.JobIndexing)
+		return repo.IndexDocById(index, id)
+	}
+}
+
+// availableUpdates returns the installed docsets with a newer revision in the
+// feeds as last fetched.
+func availableUpdates(repos []zealindex.DocsRepo) ([]zealindex.RepoItem, error) {
+	items := []zealindex.RepoItem{}
+	for _, repo := range repos {
+		installed, err := repo.GetInstalled()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range installed {
+			if item.UpdateAvailable {
+				items = append(items, item)
+			}
+		}
+	}
+	return items, nil
+}
+
+// refreshFeeds fetches the feeds of all repos which have one.  Feeds
+// which can't be fetched don't stop the others from being refreshed.
+func refreshFeeds(repos []zealindex.DocsRepo) error {
+	var failed []string
+	for _, repo := range repos {
+		if fed, ok := repo.(zealindex.FeedRepo); ok {
+			if err := fed.RefreshFeed(); err != nil {
+				failed = append(failed, repo.Name()+": "+err.Error())
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// checkUpdatesEvery refreshes the feeds periodically, logging how many
+// docsets can be updated.  Nothing is updated without being asked to.
+func checkUpdatesEvery(interval time.Duration, repos []zealindex.DocsRepo) {
+	for range time.Tick(interval) {
+		if err := refreshFeeds(repos); err != nil {
+			fmt.Println("failed to check for updates: " + err.Error())
+			continue
+		}
+		if updates, err := availableUpdates(repos); err == nil && len(updates) > 0 {
+			fmt.Println(strconv.Itoa(len(updates)) + " docset update(s) available")
+		}
+	}
+}
+
+// findDocset returns the indexed docset with the given id.
+func findDocset(index *zealindex.GlobalIndex, id string) (zealindex.IndexedDocset, bool) {
+	for _, seg := range index.Snapshot().Segments {
+		if seg.Docset.Id == id {
+			return seg.Docset, true
+		}
+	}
+	return zealindex.IndexedDocset{}, false
+}
+
+// jobError responds with 404 for unknown jobs, 409 for finished ones and 500
+// for other errors.
+func jobError(c *gin.Context, err error) {
+	if err == zealindex.ErrJobNotFound {
+		c.Data(404, "text/plain", []byte("Not found"))
+	} else if err == zealindex.ErrJobFinished {
+		c.Data(409, "text/plain", []byte(err.Error()))
+	} else {
+		c.Data(500, "text/plain", []byte(err.Error()))
+	}
+}
+
+// availableItems responds with the docsets available in the repo, sorted by
+// name.
+func availableItems(c *gin.Context, repo zealindex.DocsRepo) {
+	var b []byte
+	items, err := repo.GetAvailableForInstall()
+	if err == nil {
+		sort.Slice(items, func(i, j int) bool {
+			return strings.Compare(strings.ToLower(items[i].Name),
+				strings.ToLower(items[j].Name)) < 0
+		})
+		b, err = json.Marshal(items)
+	}
+	if err != nil {
+		c.Data(500, "text/plain", []byte(err.Error()))
+	} else {
+		c.Data(200, "application/json", b)
+	}
+}
+
+// ids of repos in /repo/:id/items and /repo/:id/refresh
+var repoNamesById = map[int]string{1: "com.kapeli", 2: "com.kapeli.contrib"}
+
 func main() {
-	dataDir := xdg.DataHome() + "/zealcore"
-	os.Mkdir(dataDir, 0700)
-	os.Chdir(dataDir)
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	for _, name := range cfg.Repos {
+		known := false
+		for _, repo := range availableRepos {
+			known = known || repo.name == name
+		}
+		if !known {
+			fmt.Fprintln(os.Stderr, "unknown repo: "+name)
+			os.Exit(2)
+		}
+	}
+
+	if err = os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	zealindex.DataDir = cfg.DataDir
+	zealindex.CleanupPartialFiles()
+	zealindex.Feeds = cfg.Feeds
+	zealindex.FullTextOnInstall = cfg.FullText
+	zealindex.FeedTTL, _ = cfg.feedTTL()
+	if err = zealindex.OpenCacheDB(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
 
-	var index zealindex.GlobalIndex
+	var index *zealindex.GlobalIndex
 
-	repos := []zealindex.DocsRepo{
-		zealindex.NewDashRepo(),
-		zealindex.NewDashContribRepo(),
-		zealindex.NewDashLocalRepo(),
-		zealindex.NewDocbooksRepo(),
+	var repos []zealindex.DocsRepo
+	for _, repo := range availableRepos {
+		if cfg.repoEnabled(repo.name) {
+			created, err := repo.create()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, repo.name+": "+err.Error())
+				os.Exit(1)
+			}
+			repos = append(repos, created)
+		}
 	}
 	reposByName := make(map[string]zealindex.DocsRepo)
 	for _, source := range repos {
 		reposByName[source.Name()] = source
 	}
 
-	index = createGlobalIndex(repos)
+	index = createGlobalIndex(repos, cfg.TrigramIndex)
+	index.SetRanking(zealindex.LoadRanking())
+
+	policy, err := newAccessPolicy(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
 
-	router := gin.Default()
-	router.Static("/html", "./html")
+	router := gin.New()
+	router.Use(takeQueryToken, gin.Logger(), gin.Recovery(), policy.middleware())
+	router.GET("/auth", policy.login)
+	router.Static("/html", filepath.Join(cfg.DataDir, "html"))
 	router.GET("/index", func(c *gin.Context) {
 		c.Data(200, "application/json", []byte("[{\"name\": \"api.zealdocs.org\", \"id\": 1}]"))
 	})
@@ -161,27 +521,31 @@ func main() {
 	})
 	router.GET("/repo/:id/items", func(c *gin.Context) {
 		repoId, err := strconv.Atoi(c.Param("id"))
-		if err == nil && repoId < 3 {
-			var b []byte
-			items, err := repos[repoId-1].GetAvailableForInstall()
-			if err == nil {
-				sort.Slice(items, func(i, j int) bool {
-					return strings.Compare(strings.ToLower(items[i].Name),
-										   strings.ToLower(items[j].Name)) < 0
-				})
-				b, err = json.Marshal(items)
-			}
-			if err != nil {
-				c.Data(500, "text/plain", []byte(err.Error()))
-			} else {
-				c.Data(200, "application/json", b)
-			}
+		repo, enabled := reposByName[repoNamesById[repoId]]
+		if err == nil && enabled {
+			availableItems(c, repo)
 			return
 		}
 		c.Data(404, "text/plain", []byte("not found"))
 	})
 
+	router.POST("/repo/:id/refresh", func(c *gin.Context) {
+		repoId, err := strconv.Atoi(c.Param("id"))
+		repo, enabled := reposByName[repoNamesById[repoId]]
+		fed, ok := repo.(zealindex.FeedRepo)
+		if err != nil || !enabled || !ok {
+			c.Data(404, "text/plain", []byte("not found"))
+			return
+		}
+		if err = fed.RefreshFeed(); err != nil {
+			c.Data(502, "text/plain", []byte(err.Error()))
+			return
+		}
+		availableItems(c, repo)
+	})
+
 	downloadProgressHandlers := zealindex.NewProgressHandlers()
+	jobs := zealindex.NewJobManager(cfg.MaxJobs, &downloadProgressHandlers)
 
 	router.POST("/item", func(c *gin.Context) {
 		var item postItem
@@ -194,15 +558,24 @@ func main() {
 				if item.Repo != "" && repo.Name() != item.Repo {
 					continue
 				}
-				installingName := repo.StartDocsetInstallById(item.Id, downloadProgressHandlers, func() {
-					index.Lock.Lock()
-					repo.IndexDocById(index, item.Id)
-					index.Lock.Unlock()
-				})
-				if installingName != "" {
-					c.Data(200, "text/plain", []byte(installingName))
+				repoItem, ok := repo.GetAvailableItem(item.Id)
+				if !ok {
+					continue
+				}
+				if item.Version != "" && !repoItem.HasVersion(item.Version) {
+					c.Data(404, "text/plain", []byte("unknown version"))
 					return
 				}
+				repoItem.Version = item.Version
+				repoItem.Pinned = item.Version != ""
+				key := zealindex.DocsetKey(repoItem.Id, item.Version)
+				job := jobs.Submit(zealindex.JobInstall, repo.Name(), key, repoItem.Title,
+					installJob(repo, index, key, func(ctx context.Context, job *zealindex.RunningJob) error {
+						return repo.InstallDocset(ctx, repoItem, job)
+					}))
+				c.Header("Location", "/jobs/"+job.Id)
+				c.Data(200, "text/plain", []byte(repoItem.Name))
+				return
 			}
 			c.Data(404, "text/plain", []byte("not found"))
 		} else {
@@ -210,72 +583,99 @@ func main() {
 		}
 	})
 	router.POST("/item/local/:title/:len", func(c *gin.Context) {
-		for _, repo := range repos {
-			if repo.Name() != "com.kapeli.local" {
-				continue
+		repo, enabled := reposByName["com.kapeli.local"]
+		if !enabled {
+			c.Data(404, "text/plain", []byte("not found"))
+			return
+		}
+		len, err := strconv.ParseInt(c.Param("len"), 10, 64)
+		if err != nil {
+			c.Data(400, "text/plain", []byte("invalid length"))
+			return
+		}
+		f, _, err := c.Request.FormFile("file")
+		if err != nil {
+			c.Data(400, "text/plain", []byte(err.Error()))
+			return
+		}
+		defer f.Close()
+		icon := c.Request.FormValue("icon")
+		icon2x := c.Request.FormValue("icon2x")
+
+		repoItem := zealindex.RepoItem{
+			SourceId:     "com.kapeli.local",
+			Name:         c.Param("title"),
+			Title:        c.Param("title"),
+			Versions:     make([]string, 0),
+			Revision:     "local",
+			Icon:         string(icon),
+			Icon2x:       string(icon2x),
+			SymbolCounts: make(map[string]int),
+		}
+
+		// the upload is copied so that the request can complete before the
+		// docset is extracted
+		tmpBody, err := ioutil.TempFile(zealindex.TempDir(), "zealcore-data")
+		if err == nil {
+			if _, err = io.Copy(tmpBody, f); err == nil {
+				_, err = tmpBody.Seek(0, 0)
+			}
+			if err != nil {
+				tmpBody.Close()
+				os.Remove(tmpBody.Name())
 			}
-			len, err := strconv.ParseInt(c.Param("len"), 10, 64)
-			icon := c.Request.FormValue("icon")
-			icon2x := c.Request.FormValue("icon2x")
-
-			repoItem := zealindex.RepoItem{
-				"com.kapeli.local",
-				c.Param("title"),
-				c.Param("title"),
-				make([]string, 0),
-				"local",
-				string(icon),
-				string(icon2x),
-				"",
-				zealindex.RepoItemExtra{""},
-				"",
-				"",
-				"",
-				make(map[string]int),
-			}
-			marshaled, err := json.Marshal(repoItem)
-			check(err)
+		}
+		if err != nil {
+			c.Data(500, "text/plain", []byte(err.Error()))
+			return
+		}
+
+		marshaled, err := json.Marshal(repoItem)
+		if err == nil {
 			_, err = zealindex.GetCacheDB().Exec(
 				"INSERT INTO available_docs(repo_id, name, json) VALUES (?, ?, ?)",
 				3, c.Param("title"), marshaled)
-			q, err := zealindex.GetCacheDB().Query("SELECT id FROM available_docs WHERE repo_id=3 ORDER BY id DESC LIMIT 1")
-			check(err)
-			q.Next()
-			q.Scan(&repoItem.Id)
-			q.Close()
-			tmpBody, err := ioutil.TempFile("/tmp", "zealcore-data")
-			buf := make([]byte, 1024)
-			more := true
-			f, _, e := c.Request.FormFile("file")
-			check(e)
-			for more {
-				r, err := f.Read(buf)
-				tmpBody.Write(buf[:r])
-				if r == 0 || err != nil {
-					more = false
-				}
-			}
-			tmpBody.Seek(0, 0)
-			installingName := repo.StartDocsetInstallByIo(
-				tmpBody, repoItem, len,
-				downloadProgressHandlers, func() {
-					index.Lock.Lock()
-					repo.IndexDocById(index, repoItem.Id)
-					index.Lock.Unlock()
-				})
-			if installingName != "" {
-				c.Data(200, "text/plain", []byte(installingName))
-				return
-			}
 		}
+		if err == nil {
+			err = zealindex.GetCacheDB().QueryRow(
+				"SELECT id FROM available_docs WHERE repo_id=3 ORDER BY id DESC LIMIT 1").Scan(&repoItem.Id)
+		}
+		if err != nil {
+			tmpBody.Close()
+			os.Remove(tmpBody.Name())
+			c.Data(500, "text/plain", []byte(err.Error()))
+			return
+		}
+
+		job := jobs.Submit(zealindex.JobInstall, repo.Name(), repoItem.Id, repoItem.Title,
+			installJob(repo, index, repoItem.Id, func(ctx context.Context, job *zealindex.RunningJob) error {
+				return repo.InstallDocsetFromIo(ctx, tmpBody, repoItem, len, job)
+			}))
+		go (func() {
+			// also if the job is cancelled before it starts
+			jobs.Wait(context.Background(), job.Id)
+			tmpBody.Close()
+			os.Remove(tmpBody.Name())
+		})()
+		c.Header("Location", "/jobs/"+job.Id)
+		c.Data(200, "text/plain", []byte(repoItem.Title))
 	})
 	router.DELETE("/item/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		docset, _ := findDocset(index, id)
 		removed := false
-		for _, repo := range repos {
-			if repo.RemoveDocset(c.Param("id"), index) {
-				removed = true
-				break
+		job := jobs.Submit(zealindex.JobRemove, docset.RepoName, id, docset.Name, func(ctx context.Context, job *zealindex.RunningJob) error {
+			job.SetState(zealindex.JobRemoving)
+			for _, repo := range repos {
+				if repo.RemoveDocset(id, index) {
+					removed = true
+					return nil
+				}
 			}
+			return errors.New("not installed")
+		})
+		if _, err := jobs.Wait(c.Request.Context(), job.Id); err != nil {
+			return // client gone
 		}
 		if removed {
 			c.Data(200, "text/plain", []byte("OK"))
@@ -283,13 +683,97 @@ func main() {
 			c.Data(404, "text/plain", []byte("Not found"))
 		}
 	})
+	router.POST("/item/:id/update", func(c *gin.Context) {
+		id := c.Param("id")
+		pinned := ""
+		for _, repo := range repos {
+			updatable, ok := repo.(zealindex.UpdatableRepo)
+			if !ok {
+				continue
+			}
+			installed, err := repo.GetInstalled()
+			if err != nil {
+				c.Data(500, "text/plain", []byte(err.Error()))
+				return
+			}
+			for _, item := range installed {
+				if item.Id != id && zealindex.DocsetKey(item.Id, item.Version) != id {
+					continue
+				}
+				if item.Pinned {
+					pinned = item.Version
+					continue
+				}
+				if !item.UpdateAvailable {
+					c.Data(409, "text/plain", []byte(zealindex.ErrUpToDate.Error()))
+					return
+				}
+				job := jobs.Submit(zealindex.JobUpdate, repo.Name(), item.Id, item.Title, func(ctx context.Context, job *zealindex.RunningJob) error {
+					return updatable.UpdateDocset(ctx, index, item.Id, job)
+				})
+				c.Header("Location", "/jobs/"+job.Id)
+				c.Data(200, "text/plain", []byte(item.Name))
+				return
+			}
+		}
+		if pinned != "" {
+			c.Data(409, "text/plain", []byte("pinned to version "+pinned))
+			return
+		}
+		c.Data(404, "text/plain", []byte("not installed"))
+	})
+	router.GET("/updates", func(c *gin.Context) {
+		items, err := availableUpdates(repos)
+		if err != nil {
+			c.Data(500, "text/plain", []byte(err.Error()))
+			return
+		}
+		c.JSON(200, items)
+	})
+	router.POST("/updates/check", func(c *gin.Context) {
+		if err := refreshFeeds(repos); err != nil {
+			c.Data(502, "text/plain", []byte(err.Error()))
+			return
+		}
+		items, err := availableUpdates(repos)
+		if err != nil {
+			c.Data(500, "text/plain", []byte(err.Error()))
+			return
+		}
+		c.JSON(200, items)
+	})
+	router.GET("/jobs", func(c *gin.Context) {
+		c.JSON(200, jobs.Jobs())
+	})
+	router.GET("/jobs/:id", func(c *gin.Context) {
+		job, err := jobs.Get(c.Param("id"))
+		if err != nil {
+			jobError(c, err)
+			return
+		}
+		c.JSON(200, job)
+	})
+	router.DELETE("/jobs/:id", func(c *gin.Context) {
+		if err := jobs.Cancel(c.Param("id")); err != nil {
+			jobError(c, err)
+			return
+		}
+		// respond once partial files have been removed
+		if _, err := jobs.Wait(c.Request.Context(), c.Param("id")); err != nil {
+			return
+		}
+		c.Data(204, "", []byte(""))
+	})
 	router.GET("/item", func(c *gin.Context) {
 		var items []zealindex.RepoItem
 
 		for _, repo := range repos {
-			for _, docset := range repo.GetInstalled() {
-				items = append(items, docset)
+			installed, err := repo.GetInstalled()
+			if err != nil {
+				c.Data(500, "text/plain", []byte(err.Error()))
+				return
 			}
+			items = append(items, installed...)
 		}
 
 		sort.Slice(items, func(i, j int) bool {
@@ -302,127 +786,166 @@ func main() {
 		c.Data(200, "application/json", b)
 	})
 	router.GET("/group", func(c *gin.Context) {
-		db := zealindex.GetCacheDB()
-		q, err := db.Query("SELECT id, icon, name, docs_list FROM groups")
-		groups := make([]docsetGroupWithList, 0)
-		for err == nil && q.Next() {
-			var group docsetGroupWithList
-			q.Scan(&group.Id, &group.Icon, &group.Name, &group.DocsList)
-			groups = append(groups, group)
-			q.Close()
-		}
-		b, _ := json.Marshal(groups)
+		groups, err := zealindex.GetGroups()
+		if err != nil {
+			c.Data(500, "text/plain", []byte(err.Error()))
+			return
+		}
+		res := make([]docsetGroupWithList, 0, len(groups))
+		for _, group := range groups {
+			res = append(res, docsetGroupWithList{group, strings.Join(group.Docsets, ",")})
+		}
+		b, _ := json.Marshal(res)
 		c.Data(200, "application/json", b)
 	})
 	router.POST("/group", func(c *gin.Context) {
-		db := zealindex.GetCacheDB()
 		var group docsetGroup
 		body, err := ioutil.ReadAll(c.Request.Body)
 		if err == nil {
 			err = json.Unmarshal(body, &group)
 		}
+		if err == nil && group.Name == "" {
+			err = errors.New("missing group name")
+		}
+		if err != nil {
+			c.Data(400, "text/plain", []byte(err.Error()))
+			return
+		}
 
-		db.Exec("CREATE TABLE IF NOT EXISTS groups (id integer primary key autoincrement, icon, name, docs_list)")
-		db.Exec("INSERT INTO groups (icon, name) VALUES (?, ?)", group.Icon, group.Name)
-		q, err := db.Query(
-			"SELECT id FROM groups WHERE name=? AND icon=? " +
-			"ORDER BY id DESC LIMIT 1",
-			group.Name, group.Icon,
-		)
-		check(err)
-		q.Next()
-		var id string
-		q.Scan(&id)
-		q.Close()
-		c.Data(200, "text/plain", []byte(id))
+		created, err := zealindex.CreateGroup(group.Name, group.Icon)
+		if err != nil {
+			c.Data(500, "text/plain", []byte(err.Error()))
+			return
+		}
+		c.Data(201, "text/plain", []byte(created.Id))
+	})
+	router.GET("/group/:id", func(c *gin.Context) {
+		group, err := zealindex.GetGroup(c.Param("id"))
+		if err != nil {
+			groupError(c, err)
+			return
+		}
+		b, _ := json.Marshal(docsetGroupWithList{group, strings.Join(group.Docsets, ",")})
+		c.Data(200, "application/json", b)
+	})
+	router.PATCH("/group/:id", func(c *gin.Context) {
+		group, err := zealindex.GetGroup(c.Param("id"))
+		if err != nil {
+			groupError(c, err)
+			return
+		}
+		var changes docsetGroupChanges
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &changes)
+		}
+		if err == nil && changes.Name != nil && *changes.Name == "" {
+			err = errors.New("missing group name")
+		}
+		if err != nil {
+			c.Data(400, "text/plain", []byte(err.Error()))
+			return
+		}
+
+		if changes.Name != nil {
+			group.Name = *changes.Name
+		}
+		if changes.Icon != nil {
+			group.Icon = *changes.Icon
+		}
+		if changes.Position != nil {
+			group.Position = *changes.Position
+		}
+		if err = zealindex.UpdateGroup(group); err != nil {
+			groupError(c, err)
+			return
+		}
+		c.Data(204, "", []byte(""))
+	})
+	router.DELETE("/group/:id", func(c *gin.Context) {
+		if err := zealindex.DeleteGroup(c.Param("id")); err != nil {
+			groupError(c, err)
+			return
+		}
+		c.Data(204, "", []byte(""))
 	})
 	router.POST("/group/:id/doc/:docset", func(c *gin.Context) {
-		db := zealindex.GetCacheDB()
-		q, err := db.Query(
-			"SELECT docs_list FROM groups WHERE id=?", c.Param("id"),
-		)
-		check(err)
-		if q.Next() {
-			var docsList string
-			q.Scan(&docsList)
-			q.Close()
-			oldList := strings.Split(docsList, ",");
-			newList := append(oldList, c.Param("docset"))
-			newStr := strings.Join(newList, ",")
-			db.Exec("UPDATE groups SET docs_list = ? WHERE id = ?",
-				newStr, c.Param("id"))
-		} else {
-			q.Close()
+		ids, err := resolveDocsets(index, []string{c.Param("docset")})
+		if err != nil {
+			c.Data(400, "text/plain", []byte(err.Error()))
+			return
+		}
+		if err = zealindex.AddGroupMembers(c.Param("id"), ids); err != nil {
+			groupError(c, err)
+			return
 		}
-		c.Data(204, "", []byte(""));
+		c.Data(204, "", []byte(""))
 	})
 	router.GET("/group/:id/doc", func(c *gin.Context) {
-		db := zealindex.GetCacheDB()
-		q, err := db.Query(
-			"SELECT docs_list FROM groups WHERE id=?", c.Param("id"),
-		)
-		check(err)
-		if q.Next() {
-			var docsList string
-			q.Scan(&docsList)
-			c.Data(200, "text/plain", []byte(docsList))
-		} else {
-			c.Data(404, "text/plain", []byte("Not found"))
+		group, err := zealindex.GetGroup(c.Param("id"))
+		if err != nil {
+			groupError(c, err)
+			return
 		}
-		q.Close()
-	})
-	router.POST("/group/:id/doc", func(c *gin.Context) {
-		db := zealindex.GetCacheDB()
-		q, err := db.Query(
-			"SELECT docs_list FROM groups WHERE id=?", c.Param("id"),
-		)
-		check(err)
-		if q.Next() {
-			var docsList string
-			q.Scan(&docsList)
-			q.Close()
-			name, _ := ioutil.ReadAll(c.Request.Body)
-			if docsList == "" {
-				docsList = string(name)
-			} else {
-				docsList += "," + string(name)
-			}
-			db.Exec("UPDATE groups SET docs_list = ? WHERE id = ?",
-					docsList, c.Param("id"))
-			c.Data(200, "text/plain", []byte(docsList))
+		c.Data(200, "text/plain", []byte(strings.Join(group.Docsets, ",")))
+	})
+	// POST appends docsets to the group, PUT replaces its docsets, which can
+	// also be used to reorder them.
+	changeGroupDocs := func(c *gin.Context) {
+		names, _ := ioutil.ReadAll(c.Request.Body)
+		var ids []string
+		var err error
+		if len(names) > 0 {
+			ids, err = resolveDocsets(index, strings.Split(string(names), ","))
+		}
+		if err != nil {
+			c.Data(400, "text/plain", []byte(err.Error()))
+			return
+		}
+		if c.Request.Method == "PUT" {
+			err = zealindex.SetGroupMembers(c.Param("id"), ids)
 		} else {
-			q.Close()
-			c.Data(404, "text/plain", []byte("Not found"))
+			err = zealindex.AddGroupMembers(c.Param("id"), ids)
 		}
-	})
+		if err != nil {
+			groupError(c, err)
+			return
+		}
+		group, err := zealindex.GetGroup(c.Param("id"))
+		if err != nil {
+			groupError(c, err)
+			return
+		}
+		c.Data(200, "text/plain", []byte(strings.Join(group.Docsets, ",")))
+	}
+	router.POST("/group/:id/doc", changeGroupDocs)
+	router.PUT("/group/:id/doc", changeGroupDocs)
 	router.DELETE("/group/:id/doc/:docset", func(c *gin.Context) {
-		db := zealindex.GetCacheDB()
-		q, err := db.Query(
-			"SELECT docs_list FROM groups WHERE id=?", c.Param("id"),
-		)
-		check(err)
-		if q.Next() {
-			var docsList string
-			q.Scan(&docsList)
-			q.Close()
-			oldList := strings.Split(docsList, ",");
-			var newList []string;
-			for i := 0; i < len(oldList); i += 1 {
-				if oldList[i] != c.Param("docset") {
-					newList = append(newList, oldList[i])
+		group, err := zealindex.GetGroup(c.Param("id"))
+		if err != nil {
+			groupError(c, err)
+			return
+		}
+		toRemove := map[string]bool{c.Param("docset"): true}
+		for _, ds := range index.Snapshot().FindDocsets(c.Param("docset")) {
+			toRemove[groupMember(c.Param("docset"), ds)] = true
+		}
+		removed := false
+		for _, docset := range group.Docsets {
+			if toRemove[docset] {
+				found, err := zealindex.RemoveGroupMember(group.Id, docset)
+				if err != nil {
+					groupError(c, err)
+					return
 				}
+				removed = removed || found
 			}
-			newStr := strings.Join(newList, ",")
-			if newStr == "" {
-				db.Exec("DELETE FROM groups WHERE id = ?", c.Param("id"));
-			} else {
-				db.Exec("UPDATE groups SET docs_list = ? WHERE id = ?",
-					newStr, c.Param("id"))
-			}
-		} else {
-			q.Close()
 		}
-		c.Data(204, "", []byte(""));
+		if !removed {
+			c.Data(404, "text/plain", []byte("Not found"))
+			return
+		}
+		c.Data(204, "", []byte(""))
 	})
 	router.GET("/item/:docset/:type/*path", func(c *gin.Context) {
 		if c.Param("type") != "symbols" && c.Param("type") != "chapters" {
@@ -431,7 +954,11 @@ func main() {
 		id := c.Param("docset")
 		if c.Param("type") == "chapters" {
 			for _, repo := range repos {
-				res := repo.GetChapters(id, c.Param("path")[1:])
+				res, err := repo.GetChapters(id, c.Param("path")[1:])
+				if err != nil {
+					c.Data(400, "text/plain", []byte(err.Error()))
+					return
+				}
 				if len(res) > 0 {
 					b, _ := json.Marshal(res)
 					c.Data(200, "application/json", b)
@@ -451,11 +978,144 @@ func main() {
 		c.Data(200, "application/json", []byte("[]"))
 	})
 
+	router.GET("/api/search", MakeRestSearchHandler(index, repos))
+	router.GET("/fulltext/:id", func(c *gin.Context) {
+		for _, repo := range repos {
+			if ftRepo, ok := repo.(zealindex.FullTextRepo); ok && ftRepo.HasFullTextIndex(c.Param("id")) {
+				c.Data(200, "text/plain", []byte("OK"))
+				return
+			}
+		}
+		c.Data(404, "text/plain", []byte("Not found"))
+	})
+	router.POST("/fulltext/:id", func(c *gin.Context) {
+		// can take a while for big docsets, so the index is built in the
+		// background
+		id := c.Param("id")
+		for _, repo := range repos {
+			ftRepo, ok := repo.(zealindex.FullTextRepo)
+			if !ok {
+				continue
+			}
+			installed, err := repo.GetInstalled()
+			if err != nil {
+				c.Data(500, "text/plain", []byte(err.Error()))
+				return
+			}
+			for _, item := range installed {
+				if item.Id == id || zealindex.DocsetKey(item.Id, item.Version) == id {
+					go (func() {
+						if err := ftRepo.BuildFullTextIndex(id); err != nil {
+							fmt.Println("failed to build full-text index of " + id + ": " + err.Error())
+						}
+					})()
+					c.Data(202, "text/plain", []byte("Accepted"))
+					return
+				}
+			}
+		}
+		c.Data(404, "text/plain", []byte("Not found"))
+	})
+	router.DELETE("/fulltext/:id", func(c *gin.Context) {
+		for _, repo := range repos {
+			if ftRepo, ok := repo.(zealindex.FullTextRepo); ok && ftRepo.HasFullTextIndex(c.Param("id")) {
+				if err := ftRepo.RemoveFullTextIndex(c.Param("id")); err != nil {
+					c.Data(500, "text/plain", []byte(err.Error()))
+				} else {
+					c.Data(204, "", []byte(""))
+				}
+				return
+			}
+		}
+		c.Data(404, "text/plain", []byte("Not found"))
+	})
+	router.GET("/aliases/:docset", func(c *gin.Context) {
+		for _, seg := range index.Snapshot().Segments {
+			if seg.Docset.Id == c.Param("docset") {
+				b, _ := json.Marshal(seg.Docset)
+				c.Data(200, "application/json", b)
+				return
+			}
+		}
+		c.Data(404, "text/plain", []byte("Not found"))
+	})
+	router.PUT("/aliases/:docset", func(c *gin.Context) {
+		var aliases []string
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &aliases)
+		}
+		if err != nil {
+			c.Data(400, "text/plain", []byte(err.Error()))
+			return
+		}
+		for i := range aliases {
+			if aliases[i], err = zealindex.NormalizeAlias(aliases[i]); err != nil {
+				c.Data(400, "text/plain", []byte(err.Error()))
+				return
+			}
+		}
+		for _, seg := range index.Snapshot().Segments {
+			if seg.Docset.Id != c.Param("docset") {
+				continue
+			}
+			if err := zealindex.SaveAliases(seg.Docset.RepoName, seg.Docset.Id, aliases); err != nil {
+				c.Data(500, "text/plain", []byte(err.Error()))
+				return
+			}
+			index.SetAliases(seg.Docset.RepoName, seg.Docset.Id, aliases)
+			c.Data(204, "", []byte(""))
+			return
+		}
+		c.Data(404, "text/plain", []byte("Not found"))
+	})
+	router.GET("/ranking", func(c *gin.Context) {
+		c.JSON(200, index.Ranking())
+	})
+	router.PUT("/ranking", func(c *gin.Context) {
+		var ranking zealindex.Ranking
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &ranking)
+		}
+		if err != nil {
+			c.Data(400, "text/plain", []byte(err.Error()))
+			return
+		}
+		lowered := make(map[string]int)
+		for k, v := range ranking.DocsetWeights {
+			lowered[strings.ToLower(k)] = v
+		}
+		ranking.DocsetWeights = lowered
+		// types are matched as normalized by MapType, like "method" as "Method"
+		types := make(map[string]int)
+		for k, v := range ranking.TypeWeights {
+			types[zealindex.MapType(k)] = v
+		}
+		ranking.TypeWeights = types
+		if err = zealindex.SaveRanking(ranking); err != nil {
+			c.Data(500, "text/plain", []byte(err.Error()))
+			return
+		}
+		index.SetRanking(ranking)
+		c.Data(204, "", []byte(""))
+	})
+	router.POST("/recent", func(c *gin.Context) {
+		// lets clients report the exact symbol opened, page loads through
+		// /docs are recorded automatically
+		path, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil || len(path) == 0 {
+			c.Data(400, "text/plain", []byte("path expected"))
+			return
+		}
+		index.RecordOpened(strings.TrimPrefix(string(path), "docs/"))
+		c.Data(204, "", []byte(""))
+	})
 	router.GET("/search", func(c *gin.Context) {
-		websocket.Handler(MakeSearchServer(&index, "*")).ServeHTTP(c.Writer, c.Request)
+		websocket.Handler(MakeSearchServer(index, repos, "*")).ServeHTTP(c.Writer, c.Request)
 	})
 	router.GET("/search/group/:groupid", func(c *gin.Context) {
-		websocket.Handler(MakeSearchServer(&index, c.Param("groupid"))).ServeHTTP(c.Writer, c.Request)
+		websocket.Handler(MakeSearchServer(index, repos, c.Param("groupid"))).ServeHTTP(c.Writer, c.Request)
 	})
 	lastDownloadHandler := 0
 
@@ -498,6 +1158,9 @@ func main() {
 			err := repo.GetPage(c.Param("path"), c.Writer)
 			if err == nil {
 				found = true
+				if ext := filepath.Ext(c.Param("path")); ext == ".html" || ext == ".htm" {
+					index.RecordOpened(c.Param("path")[1:])
+				}
 				break
 			}
 		}
@@ -513,5 +1176,67 @@ func main() {
 	router.GET("/docs/*path", pathHandler)
 	router.GET("/usr/share/gtk-doc/html/*path", pathHandler)
 
-	router.Run("127.0.0.1:12340")
-}
\ No newline at end of file
+	listener, err := listen(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if interval, _ := cfg.updateInterval(); interval > 0 {
+		go checkUpdatesEvery(interval, repos)
+	}
+	fmt.Println("Listening on " + listener.Addr().String())
+	os.Exit(serve(listener, router, jobs))
+}
+
+// serve handles requests until SIGINT or SIGTERM, then shuts down gracefully,
+// returning the exit status.  Jobs are cancelled, and files they leave behind
+// are removed once they stopped.
+func serve(listener net.Listener, handler http.Handler, jobs *zealindex.JobManager) int {
+	server := &http.Server{Handler: handler}
+	serveErr := make(chan error, 1)
+	go (func() {
+		serveErr <- server.Serve(listener)
+	})()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	case sig := <-signals:
+		fmt.Println("Received " + sig.String() + ", shutting down")
+	}
+	jobs.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	go (func() {
+		// a second signal skips waiting
+		<-signals
+		cancel()
+	})()
+
+	status := 0
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to finish requests: "+err.Error())
+		status = 1
+	}
+	if !searches.wait(ctx) {
+		fmt.Fprintln(os.Stderr, "failed to finish searches")
+		status = 1
+	}
+	if !zealindex.WaitForInstalls(ctx) {
+		// the installs' goroutines still use the cache DB, so it's left
+		// open, but the files they're writing are removed
+		fmt.Fprintln(os.Stderr, "rolling back unfinished installs")
+		zealindex.CleanupPartialFiles()
+		return 1
+	}
+	zealindex.CleanupPartialFiles()
+	if err := zealindex.CloseCacheDB(); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to close the cache DB: "+err.Error())
+		status = 1
+	}
+	return status
+}
@@ -0,0 +1,156 @@
+package zealindex
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Aliases are user-defined keywords of installed docsets, like `py` for
+// "Python 3".  They are accepted everywhere a docset's name or keyword is:
+// in `alias:query` searches and in groups.
+
+// NormalizeAlias lowercases the alias, returning an error if it can't be used
+// as a search prefix.
+func NormalizeAlias(alias string) (string, error) {
+	alias = strings.ToLower(strings.TrimSpace(alias))
+	if alias == "" {
+		return "", errors.New("empty alias")
+	}
+	if strings.IndexFunc(alias, unicode.IsSpace) != -1 || strings.ContainsAny(alias, ",:.") {
+		return "", errors.New("invalid alias: " + alias)
+	}
+	return alias, nil
+}
+
+// LoadAliases returns the aliases saved for the given docset.
+func LoadAliases(repoName, id string) []string {
+	res := []string{}
+	q, err := GetCacheDB().Query(
+		"SELECT alias FROM docset_aliases WHERE repo = ? AND docset_id = ? ORDER BY rowid",
+		repoName, id)
+	if err != nil {
+		return res
+	}
+	defer q.Close()
+	for q.Next() {
+		var alias string
+		q.Scan(&alias)
+		res = append(res, alias)
+	}
+	return res
+}
+
+// SaveAliases replaces all aliases of the given docset.  The aliases must
+// already be normalized.
+func SaveAliases(repoName, id string, aliases []string) error {
+	tx, err := GetCacheDB().Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM docset_aliases WHERE repo = ? AND docset_id = ?", repoName, id)
+	for _, alias := range aliases {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(
+			"INSERT INTO docset_aliases (repo, docset_id, alias) VALUES (?, ?, ?)",
+			repoName, id, alias)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Matches checks whether name is the docset's id, or its name, keyword or
+// alias (case-insensitively).  A name followed by "@<version>" only matches
+// that installed version.
+func (ds IndexedDocset) Matches(name string) bool {
+	name, version := SplitDocsetKey(name)
+	if version != "" && !strings.EqualFold(version, ds.Version) {
+		return false
+	}
+	if name == ds.Id {
+		return true
+	}
+	name = strings.ToLower(name)
+	if name == strings.ToLower(ds.Name) {
+		return true
+	}
+	for _, kw := range ds.Keywords {
+		if name == kw {
+			return true
+		}
+	}
+	for _, alias := range ds.Aliases {
+		if name == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// FindDocsets returns the docsets in the snapshot with the given key or, if
+// there are none, all docsets with the given name, keyword or alias.
+func (s IndexSnapshot) FindDocsets(name string) []IndexedDocset {
+	var res []IndexedDocset
+	for _, seg := range s.Segments {
+		if seg.Docset.hasKey(name) {
+			res = append(res, seg.Docset)
+		}
+	}
+	if len(res) > 0 {
+		return res
+	}
+	for _, seg := range s.Segments {
+		if seg.Docset.Matches(name) {
+			res = append(res, seg.Docset)
+		}
+	}
+	return res
+}
+
+// HasDocset checks whether the snapshot has a docset with the given key,
+// name, keyword or alias.
+func (s IndexSnapshot) HasDocset(name string) bool {
+	return len(s.FindDocsets(name)) > 0
+}
+
+// UnknownDocsets returns the docsets the query is scoped to which don't
+// match any docset in the snapshot.
+func (s IndexSnapshot) UnknownDocsets(q Query) []string {
+	var res []string
+	for _, name := range q.Docsets {
+		if !s.HasDocset(name) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// SetAliases replaces the aliases of an indexed docset, returning false if
+// it isn't indexed.
+func (idx *GlobalIndex) SetAliases(repoName, id string, aliases []string) bool {
+	idx.writeLock.Lock()
+	defer idx.writeLock.Unlock()
+
+	found := false
+	old := idx.loadSegments()
+	segments := make([]*IndexSegment, len(old))
+	for i, seg := range old {
+		if seg.Docset.RepoName == repoName && seg.Docset.Id == id {
+			// segments are immutable, so swap in a copy sharing the entries
+			updated := *seg
+			updated.Docset.Aliases = aliases
+			seg = &updated
+			found = true
+		}
+		segments[i] = seg
+	}
+	if found {
+		idx.segments.Store(segments)
+	}
+	return found
+}
@@ -1,7 +0,0 @@
-package zealindex
-
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
@@ -2,15 +2,18 @@ package zealindex
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"github.com/kyoh86/xdg"
 	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -59,29 +62,73 @@ func (d DocbooksRepo) Name() string {
 	return "org.gnome"
 }
 
-func LoadDocBook(f *os.File, gz bool) Docbook {
+func LoadDocBook(f *os.File, gz bool) (Docbook, error) {
 	var r io.Reader
+	res := Docbook{}
 
 	if gz {
-		r, _ = gzip.NewReader(f)
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			return res, err
+		}
+		r = gzr
 	} else {
 		r = f
 	}
-	buf, _ := ioutil.ReadAll(r)
-	res := Docbook{}
-	_ = xml.Unmarshal(buf, &res)
-	return res
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return res, err
+	}
+	err = xml.Unmarshal(buf, &res)
+	return res, err
+}
+
+// loadDocBookFile reads the .devhelp, .devhelp2 or .devhelp.gz file at path.
+func loadDocBookFile(path string) (Docbook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Docbook{}, err
+	}
+	defer f.Close()
+	return LoadDocBook(f, strings.HasSuffix(path, ".gz"))
+}
+
+// docbookCachePath returns where the index of the docbook file is cached.
+func docbookCachePath(file string) string {
+	return dataPath(filepath.Base(file) + ".zealidx")
+}
+
+// loadIndexedDocBook reads the docbook file together with its index entries,
+// from the cache if it's up to date.
+func loadIndexedDocBook(file string) (Docbook, []IndexEntry, map[string]int, error) {
+	if cached, err := loadIndexCache(file, docbookCachePath(file)); err == nil && cached.Docbook != nil {
+		return *cached.Docbook, cached.Entries, cached.SymbolCounts, nil
+	}
+	db, err := loadDocBookFile(file)
+	if err != nil {
+		return db, nil, nil, err
+	}
+	entries, counts := docbookEntries(db)
+	err = saveIndexCache(file, docbookCachePath(file), cachedIndex{Entries: entries, SymbolCounts: counts, Docbook: &db})
+	if err != nil {
+		fmt.Println("failed to cache index of " + file + ": " + err.Error())
+	}
+	return db, entries, counts, nil
 }
 
 func (d DocbooksRepo) GetAvailableForInstall() ([]RepoItem, error) {
 	return make([]RepoItem, 0), nil
 }
 
-func (d DocbooksRepo) StartDocsetInstallById(id string, handlers ProgressHandlers, completed func()) string {
-	return ""
+func (d DocbooksRepo) GetAvailableItem(id string) (RepoItem, bool) {
+	return RepoItem{}, false
+}
+
+func (d DocbooksRepo) InstallDocset(ctx context.Context, item RepoItem, job *RunningJob) error {
+	return errors.New("docbooks can't be installed")
 }
 
-func (d DocbooksRepo) GetInstalled() []RepoItem {
+func (d DocbooksRepo) GetInstalled() ([]RepoItem, error) {
 	var gnomeIconBytes, gnomeIcon2xBytes []byte
 	var err error
 	if _, err := os.Stat("/app/share/icons/gnome/16x16/places/gnome-foot.png"); os.IsNotExist(err) {
@@ -104,35 +151,32 @@ func (d DocbooksRepo) GetInstalled() []RepoItem {
 	for i, docbook := range *d.names {
 		if docbook != "" {
 			newItem := RepoItem{
-				d.Name(),
-				(*d.names)[i],
-				(*d.names)[i],
-				[]string{},
-				"",
-				gnomeIcon,
-				gnomeIcon2x,
-				(*d.docBooks)[i].Language,
-				RepoItemExtra{""},
-				(*d.names)[i],
-				"",
-				"",
-				(*d.symbolCounts)[(*d.names)[i]],
+				SourceId:     d.Name(),
+				Name:         (*d.names)[i],
+				Title:        (*d.names)[i],
+				Versions:     []string{},
+				Icon:         gnomeIcon,
+				Icon2x:       gnomeIcon2x,
+				Language:     (*d.docBooks)[i].Language,
+				Id:           (*d.names)[i],
+				SymbolCounts: (*d.symbolCounts)[(*d.names)[i]],
 			}
 			items = append(items, newItem)
 		}
 	}
-	return items
+	return items, nil
 }
 
-func (d DocbooksRepo) GetSymbols(index GlobalIndex, id, tp string) [][]string {
+func (d DocbooksRepo) GetSymbols(index *GlobalIndex, id, tp string) [][]string {
 	var res [][]string
-	for i, s := range *index.Types {
-		name := (*index.DocsetNames)[(*index.Docsets)[i]]
-		if name[0] != d.Name() {
+	for _, seg := range index.Snapshot().Segments {
+		if seg.Docset.RepoName != d.Name() || seg.Docset.Name != id {
 			continue
 		}
-		if s == tp && (name[1] == id) {
-			res = append(res, []string{(*index.All)[i], "docs/" + (*index.Paths)[i]})
+		for _, entry := range seg.Entries {
+			if entry.Type == tp {
+				res = append(res, []string{entry.Name, "docs/" + entry.Path})
+			}
 		}
 	}
 	return res
@@ -166,7 +210,7 @@ func (d DocbooksRepo) GetPage(qPath string, w io.Writer) error {
 	return errors.New("not found")
 }
 
-func (d DocbooksRepo) GetChapters(id, path string) [][]string {
+func (d DocbooksRepo) GetChapters(id, path string) ([][]string, error) {
 	var res [][]string
 	for i, name := range *d.names {
 		if id == name {
@@ -176,7 +220,9 @@ func (d DocbooksRepo) GetChapters(id, path string) [][]string {
 			for i := 0; i < len(parts); i += 1 {
 				for _, chap2 := range chaps {
 					unescaped, err := url.QueryUnescape(parts[i])
-					check(err)
+					if err != nil {
+						return nil, err
+					}
 					if chap2.Name == unescaped {
 						chap = chap2
 						chaps = chap.Subs
@@ -190,59 +236,81 @@ func (d DocbooksRepo) GetChapters(id, path string) [][]string {
 			}
 		}
 	}
-	return res
+	return res, nil
 }
 
 type newDocBook struct {
-	db   Docbook
-	path string
-	name string
+	db      Docbook
+	path    string
+	name    string
+	file    string
+	entries []IndexEntry
+	counts  map[string]int
+	err     error
 }
 
-func (dr DocbooksRepo) IndexDocById(idx GlobalIndex, id string) {
-	re := regexp.MustCompile("(.*) \\(([^()]+) ([^()]+)\\)")
+var docbookKwRe = regexp.MustCompile("(.*) \\(([^()]+) ([^()]+)\\)")
 
+// docbookEntries returns the index entries of the docbook's functions and
+// keywords, and the number of symbols of each type.
+func docbookEntries(d Docbook) ([]IndexEntry, map[string]int) {
+	var entries []IndexEntry
+	counts := make(map[string]int)
+	processKw := func(kw DocbookKw) {
+		kwStr := kw.Name
+		typeMatched := ""
+		if docbookKwRe.MatchString(kwStr) {
+			sm := docbookKwRe.FindStringSubmatch(kwStr)
+			if sm[2] != "built-in" {
+				kwStr = sm[2] + "." + sm[1]
+				// replace values like `getv() (GObject.Object method)` with values like `GObject.Object.getv()`
+				// (for consistency with Zeal/Dash)
+			}
+			typeMatched = sm[3]
+		}
+
+		tp := MapType(kw.Type)
+		if typeMatched != "" {
+			tp = MapType(typeMatched)
+		}
+		counts[tp] += 1
+		entries = append(entries, IndexEntry{
+			Name:   kwStr,
+			Munged: Munge(kwStr),
+			Path:   d.Name + ".docbook/" + kw.Link,
+			Type:   tp,
+		})
+	}
+	for _, c := range d.Functions {
+		processKw(c)
+	}
+	for _, c := range d.Keywords {
+		processKw(c)
+	}
+	return entries, counts
+}
+
+func (dr DocbooksRepo) addToIndex(idx *GlobalIndex, d Docbook, entries []IndexEntry, counts map[string]int) {
+	(*dr.symbolCounts)[d.Name] = counts
+	idx.Add(IndexedDocset{dr.Name(), d.Name, d.Name, docsetKeywords(d.Name, d.Title), LoadAliases(dr.Name(), d.Name), ""}, entries)
+}
+
+func (dr DocbooksRepo) IndexDocById(idx *GlobalIndex, id string) error {
+	found := false
 	for _, d := range *dr.docBooks {
 		if d.Name == id {
-			docsetNum := len(*(idx.DocsetNames))
-			*(idx.DocsetNames) = append(*(idx.DocsetNames), []string{dr.Name(), d.Name, d.Name})
-			(*dr.symbolCounts)[d.Name] = make(map[string]int)
-			processKw := func(kw DocbookKw) {
-				kwStr := kw.Name
-				typeMatched := ""
-				if re.MatchString(kwStr) {
-					sm := re.FindStringSubmatch(kwStr)
-					if sm[2] != "built-in" {
-						kwStr = sm[2] + "." + sm[1]
-						// replace values like `getv() (GObject.Object method)` with values like `GObject.Object.getv()`
-						// (for consistency with Zeal/Dash)
-					}
-					typeMatched = sm[3]
-				}
-
-				*(idx.All) = append(*(idx.All), kwStr)
-				*(idx.AllMunged) = append(*(idx.AllMunged), Munge(kwStr))
-				*(idx.Docsets) = append(*(idx.Docsets), docsetNum)
-				if typeMatched != "" {
-					*(idx.Types) = append(*(idx.Types), MapType(typeMatched))
-					(*dr.symbolCounts)[d.Name][MapType(typeMatched)] += 1
-				} else {
-					*(idx.Types) = append(*(idx.Types), MapType(kw.Type))
-					(*dr.symbolCounts)[d.Name][MapType(kw.Type)] += 1
-				}
-				*(idx.Paths) = append(*(idx.Paths), d.Name+".docbook/"+kw.Link)
-			}
-			for _, c := range d.Functions {
-				processKw(c)
-			}
-			for _, c := range d.Keywords {
-				processKw(c)
-			}
+			entries, counts := docbookEntries(d)
+			dr.addToIndex(idx, d, entries, counts)
+			found = true
 		}
 	}
+	if !found {
+		return errors.New("not found: " + id)
+	}
+	return nil
 }
 
-func (dr DocbooksRepo) ImportAll(idx GlobalIndex) {
+func (dr DocbooksRepo) ImportAll(idx *GlobalIndex) error {
 	*(dr.docBooks) = make([]Docbook, 0)
 	*(dr.names) = make([]string, 0)
 	*(dr.paths) = make([]string, 0)
@@ -262,24 +330,12 @@ func (dr DocbooksRepo) ImportAll(idx GlobalIndex) {
 				files2, _ := ioutil.ReadDir(dir + f.Name())
 				for _, f2 := range files2 {
 					name := f2.Name()
-					if strings.HasSuffix(name, ".devhelp.gz") {
-						if !found[name] {
-							count += 1
-							go (func(path, path2 string) {
-								f3, _ := os.Open(path)
-								db := LoadDocBook(f3, true)
-								input <- newDocBook{db, path2, db.Name}
-							})(dir+f.Name()+"/"+name, dir+f.Name()+"/")
-						}
-						found[name] = true
-					}
-					if strings.HasSuffix(name, ".devhelp2") || strings.HasSuffix(name, ".devhelp") {
+					if strings.HasSuffix(name, ".devhelp.gz") || strings.HasSuffix(name, ".devhelp2") || strings.HasSuffix(name, ".devhelp") {
 						if !found[name] {
 							count += 1
 							go (func(path, path2 string) {
-								f3, _ := os.Open(path)
-								db := LoadDocBook(f3, false)
-								input <- newDocBook{db, path2, db.Name}
+								db, entries, counts, err := loadIndexedDocBook(path)
+								input <- newDocBook{db, path2, db.Name, path, entries, counts, err}
 							})(dir+f.Name()+"/"+name, dir+f.Name()+"/")
 						}
 						found[name] = true
@@ -289,24 +345,43 @@ func (dr DocbooksRepo) ImportAll(idx GlobalIndex) {
 		}
 	}
 
+	skipped := make(ImportError)
+	var loaded []newDocBook
 	for count > 0 {
 		count -= 1
 		n := <-input
+		if n.err != nil {
+			skipped[n.file] = n.err
+			continue
+		}
 
 		(*dr.docBooks) = append((*dr.docBooks), n.db)
 		(*dr.paths) = append((*dr.paths), n.path)
 		(*dr.names) = append((*dr.names), n.name)
+		loaded = append(loaded, n)
 	}
 
-	for _, d := range *dr.docBooks {
-		dr.IndexDocById(idx, d.Name)
+	for _, n := range loaded {
+		dr.addToIndex(idx, n.db, n.entries, n.counts)
+	}
+
+	// drop the caches of docbooks which were removed
+	caches, _ := filepath.Glob(dataPath("*.devhelp*.zealidx"))
+	for _, c := range caches {
+		if !found[strings.TrimSuffix(filepath.Base(c), ".zealidx")] {
+			os.Remove(c)
+		}
+	}
+	if len(skipped) > 0 {
+		return skipped
 	}
+	return nil
 }
 
-func (dr DocbooksRepo) RemoveDocset(id string, idx GlobalIndex) bool {
+func (dr DocbooksRepo) RemoveDocset(id string, idx *GlobalIndex) bool {
 	return false
 }
 
-func (d DocbooksRepo) StartDocsetInstallByIo(iostream io.ReadCloser, repoItem RepoItem, len int64, downloadProgressHandlers ProgressHandlers, completed func()) string {
-	return ""
+func (d DocbooksRepo) InstallDocsetFromIo(ctx context.Context, iostream io.Reader, repoItem RepoItem, len int64, job *RunningJob) error {
+	return errors.New("docbooks can't be installed")
 }
\ No newline at end of file
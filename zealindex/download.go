@@ -0,0 +1,239 @@
+package zealindex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Downloads are attempted this many times per URL, taking the URLs in turn.
+const downloadAttemptsPerURL = 3
+
+// downloadRetryDelay is multiplied by the number of failed attempts.
+var downloadRetryDelay = time.Second
+
+// mirrorURLs returns the URLs of path on all mirrors, starting at a random
+// one to spread the load.
+func mirrorURLs(mirrors []string, path string) []string {
+	if len(mirrors) == 0 {
+		return nil
+	}
+	start := rand.Intn(len(mirrors))
+	var res []string
+	for i := range mirrors {
+		res = append(res, mirrors[(start+i)%len(mirrors)]+path)
+	}
+	return res
+}
+
+// archiveURLs returns the URLs the item's archive can be downloaded from, in
+// the order they're tried.  Pinned older versions have archives of their own.
+// Dash archives are downloaded through DashDownload, which redirects to a
+// Kapeli mirror, and directly from the mirrors if that fails.
+func archiveURLs(item RepoItem) []string {
+	older := !isLatest(item)
+	if item.SourceId == "com.kapeli.contrib" {
+		archive := item.Archive
+		if older {
+			archive = item.VersionArchives[item.Version]
+		}
+		return mirrorURLs(Feeds.Contrib, item.ContribRepoKey+"/"+archive)
+	}
+	if older {
+		return append([]string{Feeds.DashDownload + item.Name + "/" + item.Version},
+			mirrorURLs(Feeds.DashMirrors, "zzz/versions/"+item.Name+"/"+item.Version+"/"+item.Name+".tgz")...)
+	}
+	return append([]string{Feeds.DashDownload + item.Name + "/latest"},
+		mirrorURLs(Feeds.DashMirrors, item.Name+".tgz")...)
+}
+
+// archiveDownload downloads an archive to a file, resuming with Range
+// requests after dropped connections.
+type archiveDownload struct {
+	urls      []string
+	path      string
+	size      int64  // expected size from the feed, 0 if unknown
+	sha256    string // expected hex checksum from the feed, empty if unknown
+	total     int64  // size reported by the server, -1 if unknown
+	validator string // ETag or Last-Modified of the partial file, for If-Range
+	progress  func(received, total int64)
+}
+
+// downloadArchive downloads to path from the first URL which works, and
+// verifies the result against the size and checksum if known.  A partial
+// file left at path by an earlier attempt is resumed.
+func downloadArchive(ctx context.Context, urls []string, path string, size int64, checksum string, progress func(received, total int64)) error {
+	d := archiveDownload{urls, path, size, strings.ToLower(checksum), -1, "", progress}
+	var err error
+	for attempt := 0; attempt < downloadAttemptsPerURL*len(urls); attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(downloadRetryDelay * time.Duration(attempt)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = d.fetch(ctx, urls[attempt%len(urls)]); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		if err = d.verify(); err == nil {
+			return nil
+		}
+		// corrupt, so start from scratch
+		os.Remove(path)
+		d.validator = ""
+	}
+	return err
+}
+
+// fetch downloads the rest of the file from url.
+func (d *archiveDownload) fetch(ctx context.Context, url string) error {
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+	if d.size > 0 && offset >= d.size || d.total >= 0 && offset >= d.total {
+		return nil // complete, or too long which verify catches
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if d.validator != "" {
+			// a changed archive is sent in full instead of a range
+			req.Header.Set("If-Range", d.validator)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != offset {
+			return errors.New(url + ": unexpected range " + resp.Header.Get("Content-Range"))
+		}
+		d.total = total
+	case http.StatusOK:
+		// ranges not supported, or the archive changed
+		offset = 0
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+		d.total = resp.ContentLength
+	default:
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			os.Remove(d.path)
+			d.validator = ""
+		}
+		return errors.New(url + ": " + resp.Status)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		d.validator = etag
+	} else {
+		d.validator = resp.Header.Get("Last-Modified")
+	}
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	w := progressWriter{f, offset, d.expectedSize(), d.progress}
+	if _, err = io.Copy(&w, resp.Body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (d *archiveDownload) expectedSize() int64 {
+	if d.size > 0 {
+		return d.size
+	}
+	return d.total
+}
+
+// verify checks the downloaded file against the size and checksum.
+func (d *archiveDownload) verify() error {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if size := d.expectedSize(); size >= 0 && n != size {
+		return errors.New("expected " + strconv.FormatInt(size, 10) + " bytes, downloaded " + strconv.FormatInt(n, 10))
+	}
+	if d.sha256 != "" && hex.EncodeToString(hash.Sum(nil)) != d.sha256 {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// parseContentRange parses "bytes <start>-<end>/<total>", with total -1 if
+// it's "*".
+func parseContentRange(s string) (int64, int64, error) {
+	invalid := errors.New("invalid Content-Range: " + s)
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, invalid
+	}
+	parts := strings.SplitN(s[len("bytes "):], "/", 2)
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(parts) != 2 || len(bounds) != 2 {
+		return 0, 0, invalid
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	if parts[1] == "*" {
+		return start, -1, nil
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	return start, total, nil
+}
+
+type progressWriter struct {
+	w        io.Writer
+	written  int64
+	total    int64
+	progress func(received, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.progress(p.written, p.total)
+	return n, err
+}
@@ -0,0 +1,279 @@
+package zealindex
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	downloadRetryDelay = time.Millisecond
+}
+
+var testArchive = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+func testChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func noProgress(received, total int64) {}
+
+// archiveServer serves testArchive with Range support.  The first dropFirst
+// responses are cut off halfway through.
+type archiveServer struct {
+	lock      sync.Mutex
+	dropFirst int
+	ranges    []string // Range headers of all requests
+}
+
+func (s *archiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	drop := len(s.ranges) <= s.dropFirst
+	s.lock.Unlock()
+
+	w.Header().Set("ETag", `"archive"`)
+	start := 0
+	if rg := r.Header.Get("Range"); rg != "" && r.Header.Get("If-Range") == `"archive"` {
+		start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rg, "bytes="), "-"))
+		w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(testArchive)-1)+"/"+strconv.Itoa(len(testArchive)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(testArchive)-start))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(testArchive)))
+	}
+	if drop {
+		w.Write(testArchive[start : start+(len(testArchive)-start)/2])
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+		return
+	}
+	w.Write(testArchive[start:])
+}
+
+func downloadPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "archive.download")
+}
+
+func TestDownloadResumesAfterDroppedConnection(t *testing.T) {
+	handler := &archiveServer{dropFirst: 1}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	path := downloadPath(t)
+	err := downloadArchive(context.Background(), []string{server.URL}, path,
+		int64(len(testArchive)), testChecksum(testArchive), noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(data, testArchive) {
+		t.Errorf("downloaded %d bytes, which differ from the archive", len(data))
+	}
+	if len(handler.ranges) != 2 || handler.ranges[0] != "" || handler.ranges[1] != "bytes="+strconv.Itoa(len(testArchive)/2)+"-" {
+		t.Errorf("unexpected Range headers %q", handler.ranges)
+	}
+}
+
+func TestDownloadFailsOverToNextMirror(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	handler := &archiveServer{}
+	working := httptest.NewServer(handler)
+	defer working.Close()
+
+	path := downloadPath(t)
+	err := downloadArchive(context.Background(), []string{broken.URL, working.URL}, path,
+		0, testChecksum(testArchive), noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.ranges) != 1 {
+		t.Errorf("working mirror got %d requests, want 1", len(handler.ranges))
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	handler := &archiveServer{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	path := downloadPath(t)
+	err := downloadArchive(context.Background(), []string{server.URL}, path,
+		0, testChecksum([]byte("something else")), noProgress)
+	if err == nil || err.Error() != "checksum mismatch" {
+		t.Fatalf("got error %v, want checksum mismatch", err)
+	}
+	if len(handler.ranges) != downloadAttemptsPerURL {
+		t.Errorf("got %d attempts, want %d", len(handler.ranges), downloadAttemptsPerURL)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Error("corrupt download was kept")
+	}
+}
+
+// testDocsetArchive returns a gzipped tar archive of a docset with a single
+// page.
+func testDocsetArchive(t *testing.T, title string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	page := []byte("<html>test</html>")
+	hdr := &tar.Header{Name: title + ".docset/Contents/Resources/Documents/index.html", Mode: 0644, Size: int64(len(page)), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(page)
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// contribMirror serves a contrib index.json listing a single docset, whose
+// archive is served at <key>/<key>.tgz.
+type contribMirror struct {
+	archive  []byte
+	feed     ContribItem
+	requests int // of the archive
+}
+
+func (m *contribMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/index.json":
+		json.NewEncoder(w).Encode(map[string]map[string]ContribItem{"docsets": {"Test": m.feed}})
+	case "/Test/Test.tgz":
+		m.requests++
+		w.Write(m.archive)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// installFromMirror installs the docset listed by the mirror through
+// InstallDocset, returning the finished job.
+func installFromMirror(t *testing.T, mirror *contribMirror) Job {
+	server := httptest.NewServer(mirror)
+	defer server.Close()
+	oldFeeds := Feeds
+	Feeds.Contrib = []string{server.URL + "/"}
+	defer (func() { Feeds = oldFeeds })()
+
+	items := make(map[string]RepoItem)
+	var files []docsetFile
+	icons := make(map[string]DocsetIcons)
+	counts := make(map[string]map[string]int)
+	repo := DashRepo{&items, &sync.RWMutex{}, &files, &icons, &counts, 2}
+	if err := repo.RefreshFeed(); err != nil {
+		t.Fatal(err)
+	}
+	available, err := repo.GetAvailableForInstall()
+	if err != nil || len(available) != 1 {
+		t.Fatalf("got %d available docsets, error %v", len(available), err)
+	}
+	item := available[0]
+	if item.ArchiveSize != mirror.feed.ArchiveSize || item.ArchiveSha256 != mirror.feed.ArchiveSha256 {
+		t.Errorf("feed lists size %d and checksum %q, item has %d and %q",
+			mirror.feed.ArchiveSize, mirror.feed.ArchiveSha256, item.ArchiveSize, item.ArchiveSha256)
+	}
+
+	handlers := NewProgressHandlers()
+	jobs := NewJobManager(1, &handlers)
+	job := jobs.Submit(JobInstall, repo.Name(), item.Id, item.Name, func(ctx context.Context, job *RunningJob) error {
+		return repo.InstallDocset(ctx, item, job)
+	})
+	job, err = jobs.Wait(context.Background(), job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestInstallDocsetVerifiesArchiveFromFeed(t *testing.T) {
+	testDataDir(t)
+	archive := testDocsetArchive(t, "Test")
+	mirror := &contribMirror{archive: archive, feed: ContribItem{
+		Name: "Test", Version: "1.0", Archive: "Test.tgz",
+		ArchiveSize: int64(len(archive)), ArchiveSha256: testChecksum(archive),
+	}}
+	job := installFromMirror(t, mirror)
+	if job.State != JobDone {
+		t.Fatalf("install %s: %s", job.State, job.Error)
+	}
+	if _, err := os.Stat(docsetPath("Test")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInstallDocsetRejectsArchiveNotMatchingFeed(t *testing.T) {
+	testDataDir(t)
+	archive := testDocsetArchive(t, "Test")
+	mirror := &contribMirror{archive: archive, feed: ContribItem{
+		Name: "Test", Version: "1.0", Archive: "Test.tgz",
+		ArchiveSize: int64(len(archive)), ArchiveSha256: testChecksum([]byte("something else")),
+	}}
+	job := installFromMirror(t, mirror)
+	if job.State != JobFailed || job.Error != "checksum mismatch" {
+		t.Fatalf("install %s with error %q, want checksum mismatch", job.State, job.Error)
+	}
+	if mirror.requests != downloadAttemptsPerURL {
+		t.Errorf("archive downloaded %d times, want %d", mirror.requests, downloadAttemptsPerURL)
+	}
+	if _, err := os.Stat(docsetPath("Test")); !os.IsNotExist(err) {
+		t.Error("docset with a corrupt archive was installed")
+	}
+	var count int
+	GetCacheDB().QueryRow("SELECT COUNT(*) FROM installed_docs").Scan(&count)
+	if count != 0 {
+		t.Errorf("%d docsets recorded as installed", count)
+	}
+}
+
+func TestDashArchivesFallBackToKapeliMirrors(t *testing.T) {
+	oldFeeds := Feeds
+	defer (func() { Feeds = oldFeeds })()
+	Feeds.DashDownload = "https://go.example/d/"
+	Feeds.DashMirrors = []string{"https://a.example/feeds/", "https://b.example/feeds/"}
+
+	item := RepoItem{SourceId: "com.kapeli", Name: "Python_3", Versions: []string{"3.12", "3.11"}}
+	urls := archiveURLs(item)
+	sort.Strings(urls[1:]) // the mirrors are tried from a random one
+	want := []string{"https://go.example/d/Python_3/latest", "https://a.example/feeds/Python_3.tgz", "https://b.example/feeds/Python_3.tgz"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("latest version: got %q, want %q", urls, want)
+	}
+
+	item.Version = "3.11"
+	urls = archiveURLs(item)
+	sort.Strings(urls[1:])
+	want = []string{"https://go.example/d/Python_3/3.11",
+		"https://a.example/feeds/zzz/versions/Python_3/3.11/Python_3.tgz",
+		"https://b.example/feeds/zzz/versions/Python_3/3.11/Python_3.tgz"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("pinned version: got %q, want %q", urls, want)
+	}
+
+	Feeds.DashMirrors = nil
+	if urls = archiveURLs(item); len(urls) != 1 {
+		t.Errorf("without mirrors: got %q", urls)
+	}
+}
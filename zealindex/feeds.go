@@ -0,0 +1,229 @@
+package zealindex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FeedRepo is implemented by repos whose list of available docsets comes
+// from a feed.
+type FeedRepo interface {
+	// RefreshFeed fetches the feed again, unless the server reports it's
+	// unchanged, so that GetAvailableForInstall lists the current docsets
+	// and GetInstalled reports which docsets have updates.
+	RefreshFeed() error
+}
+
+// FeedTTL is how long GetAvailableForInstall uses a fetched feed before
+// fetching it again in the background, 0 to only fetch it again through
+// RefreshFeed.
+var FeedTTL = 24 * time.Hour
+
+// feedRetryDelay is how long GetAvailableForInstall waits before trying a
+// feed which couldn't be fetched again, so that offline clients don't keep
+// starting fetches.
+var feedRetryDelay = 5 * time.Minute
+
+var feedClient = &http.Client{Timeout: time.Minute}
+
+// feedLock serializes fetching feeds, which rewrites available_docs.
+var feedLock sync.Mutex
+
+// refreshingFeeds holds the ids of repos whose feed is being fetched in the
+// background.
+var refreshingFeeds sync.Map
+
+// feedState is stored in the kv table for each repo with a feed.
+type feedState struct {
+	Fetched   time.Time // when the feed was last fetched or found unchanged
+	Attempted time.Time // when fetching was last tried, failed or not
+	// by URL, as each contrib mirror has validators of its own
+	Validators map[string]feedValidators
+}
+
+// feedValidators are the headers of the last response from a feed URL, sent
+// back to find out whether the feed changed.
+type feedValidators struct {
+	ETag         string
+	LastModified string
+}
+
+func (s feedState) expired(now time.Time) bool {
+	failed := s.Attempted.After(s.Fetched)
+	return FeedTTL > 0 && now.Sub(s.Fetched) >= FeedTTL && (!failed || now.Sub(s.Attempted) >= feedRetryDelay)
+}
+
+func (d DashRepo) feedKey() string {
+	return "feed:" + d.Name()
+}
+
+func (d DashRepo) loadFeedState() feedState {
+	var res feedState
+	var value []byte
+	err := GetCacheDB().QueryRow("SELECT value FROM kv WHERE key = ?", d.feedKey()).Scan(&value)
+	if err == nil {
+		json.Unmarshal(value, &res)
+	}
+	return res
+}
+
+func (d DashRepo) saveFeedState(s feedState) error {
+	value, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = GetCacheDB().Exec("INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)", d.feedKey(), value)
+	return err
+}
+
+// feedURLs returns the URLs the repo's feed can be fetched from, in the order
+// they're tried, or nil if it has none.
+func (d DashRepo) feedURLs() []string {
+	switch d.repoId {
+	case 1:
+		return []string{Feeds.Dash}
+	case 2:
+		return mirrorURLs(Feeds.Contrib, "index.json")
+	}
+	return nil // local docsets
+}
+
+// errNotModified is returned by fetchFeedBody when the feed is unchanged.
+var errNotModified = errors.New("not modified")
+
+// fetchFeedBody fetches url, conditionally if state has validators for it,
+// and records the validators of the response in state.
+func fetchFeedBody(url string, state *feedState) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := state.Validators[url]; ok {
+		if v.ETag != "" {
+			req.Header.Set("If-None-Match", v.ETag)
+		}
+		if v.LastModified != "" {
+			req.Header.Set("If-Modified-Since", v.LastModified)
+		}
+	}
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, errNotModified
+	case http.StatusOK:
+	default:
+		return nil, errors.New(url + ": " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if state.Validators == nil {
+		state.Validators = make(map[string]feedValidators)
+	}
+	state.Validators[url] = feedValidators{resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")}
+	return body, nil
+}
+
+// fetchFeed fetches the feed from the first URL which works and updates the
+// available docsets from it.  Unless force is set, it does nothing if the
+// feed was fetched while waiting for another fetch to finish.
+func (d DashRepo) fetchFeed(force bool) ([]RepoItem, error) {
+	feedLock.Lock()
+	defer feedLock.Unlock()
+	state := d.loadFeedState()
+	now := time.Now()
+	repo, err := getRepo(d.repoId)
+	if err != nil {
+		return nil, err
+	} else if len(repo) == 0 {
+		state.Validators = nil // an unchanged feed wouldn't list anything
+	} else if !force && !state.expired(now) {
+		return repo, nil
+	}
+
+	state.Attempted = now
+	for _, url := range d.feedURLs() {
+		var body []byte
+		var items []RepoItem
+		body, err = fetchFeedBody(url, &state)
+		if err == errNotModified {
+			items, err = getRepo(d.repoId)
+		} else if err == nil {
+			items, err = d.parseFeed(url, body)
+		}
+		if err == nil {
+			state.Fetched = now
+			if err := d.saveFeedState(state); err != nil {
+				fmt.Println("failed to save state of the " + d.Name() + " feed: " + err.Error())
+			}
+			return items, nil
+		}
+	}
+	if saveErr := d.saveFeedState(state); saveErr != nil {
+		fmt.Println("failed to save state of the " + d.Name() + " feed: " + saveErr.Error())
+	}
+	return nil, err
+}
+
+func (d DashRepo) parseFeed(url string, body []byte) ([]RepoItem, error) {
+	if d.repoId == 1 {
+		return d.parseDashFeed(url, body)
+	}
+	return d.parseContribFeed(url, body)
+}
+
+func (d DashRepo) RefreshFeed() error {
+	if d.feedURLs() == nil {
+		return nil
+	}
+	_, err := d.fetchFeed(true)
+	return err
+}
+
+// refreshInBackground fetches the feed in the background if it's older than
+// FeedTTL or was never fetched, unless that's already happening.
+func (d DashRepo) refreshInBackground() {
+	if d.feedURLs() == nil {
+		return
+	}
+	if _, running := refreshingFeeds.LoadOrStore(d.repoId, true); running {
+		return
+	}
+	go (func() {
+		defer refreshingFeeds.Delete(d.repoId)
+		if _, err := d.fetchFeed(false); err != nil {
+			fmt.Println("failed to refresh the docset list of " + d.Name() + ": " + err.Error())
+		}
+	})()
+}
+
+// GetAvailableForInstall returns the docsets cached from the feed.  Once it's
+// older than FeedTTL, it's fetched again in the background, so that the
+// cached docsets are returned right away, even while offline.  The feed is
+// only waited for if nothing was cached yet.
+func (d DashRepo) GetAvailableForInstall() ([]RepoItem, error) {
+	repo, err := getRepo(d.repoId)
+	if err != nil {
+		return nil, err
+	}
+	if d.feedURLs() == nil {
+		return repo, nil
+	}
+	if len(repo) > 0 {
+		if d.loadFeedState().expired(time.Now()) {
+			d.refreshInBackground()
+		}
+		return repo, nil
+	}
+	return d.fetchFeed(false)
+}
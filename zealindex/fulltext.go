@@ -0,0 +1,249 @@
+package zealindex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"html"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Full-text indices are kept in a separate <title>.zealfts SQLite database
+// next to <title>.zealdocset in DataDir, so that building or dropping one doesn't touch
+// the docset itself.  FTS4 is used, as FTS5 isn't available in go-sqlite3
+// without extra build tags.
+
+// When set, full-text indices are built for every newly installed docset.
+var FullTextOnInstall = false
+
+type FullTextResult struct {
+	Path          string
+	Snippet       string
+	RepoName      string
+	DocsetName    string
+	DocsetId      string
+	DocsetVersion string
+}
+
+// FullTextRepo is implemented by repos supporting full-text search of
+// their docsets' pages.
+type FullTextRepo interface {
+	BuildFullTextIndex(id string) error
+	RemoveFullTextIndex(id string) error
+	HasFullTextIndex(id string) bool
+	SearchFullText(ctx context.Context, query string, allowedDocs map[string]bool, limit int) ([]FullTextResult, error)
+}
+
+var (
+	scriptsRe = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>`)
+	tagsRe    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// FullTextQueryError is returned for queries the full-text index can't
+// parse, like ones with an unbalanced quote.
+type FullTextQueryError struct {
+	Query string
+}
+
+func (e FullTextQueryError) Error() string {
+	return "invalid full-text query: " + e.Query
+}
+
+// The indexed text is unescaped, so snippets are highlighted with control
+// characters which snippetHTML turns into markup once the text is escaped.
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+var snippetMarkup = strings.NewReplacer(snippetStart, "<b>", snippetEnd, "</b>")
+
+// snippetHTML escapes the snippet and marks the matches in bold.
+func snippetHTML(snippet string) string {
+	return snippetMarkup.Replace(html.EscapeString(snippet))
+}
+
+// stripTags returns the text contents of an HTML page.
+func stripTags(page string) string {
+	page = scriptsRe.ReplaceAllString(page, " ")
+	page = tagsRe.ReplaceAllString(page, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(page)), " ")
+}
+
+func fullTextPath(file string) string {
+	return dataPath(file + ".zealfts")
+}
+
+// buildFullTextIndex indexes all HTML pages stored in docsetFile into
+// ftsFile.  The index is written to a temporary file first, so that a failed
+// build doesn't leave a partial index behind.
+func buildFullTextIndex(docsetFile, ftsFile string) error {
+	src, err := sql.Open("sqlite3", docsetFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	os.Remove(ftsFile + ".tmp")
+	dst, err := sql.Open("sqlite3", ftsFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(ftsFile + ".tmp")
+	defer dst.Close()
+
+	if _, err = dst.Exec("CREATE VIRTUAL TABLE pages USING fts4(path, body)"); err != nil {
+		return err
+	}
+
+	rows, err := src.Query("SELECT path, blob FROM files WHERE path LIKE '%.html' OR path LIKE '%.htm'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var path string
+		var blob []byte
+		if err = rows.Scan(&path, &blob); err != nil {
+			tx.Rollback()
+			return err
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		page, err := ioutil.ReadAll(gz)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec("INSERT INTO pages (path, body) VALUES (?, ?)", path, stripTags(string(page))); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	dst.Exec("INSERT INTO pages(pages) VALUES ('optimize')")
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(ftsFile+".tmp", ftsFile)
+}
+
+func searchFullTextFile(ctx context.Context, ftsFile, query string, limit int) ([][2]string, error) {
+	db, err := sql.Open("sqlite3", ftsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT path, snippet(pages, ?, ?, '…', 1, 16) FROM pages WHERE body MATCH ? LIMIT ?",
+		snippetStart, snippetEnd, query, limit)
+	if err != nil {
+		return nil, matchError(query, err)
+	}
+	defer rows.Close()
+
+	var res [][2]string
+	for rows.Next() {
+		var path, snippet string
+		if err = rows.Scan(&path, &snippet); err != nil {
+			return nil, err
+		}
+		res = append(res, [2]string{path, snippetHTML(snippet)})
+	}
+	return res, matchError(query, rows.Err())
+}
+
+// matchError turns SQLite's errors about malformed queries into
+// FullTextQueryErrors.
+func matchError(query string, err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), "malformed MATCH expression") {
+		return FullTextQueryError{query}
+	}
+	return err
+}
+
+// installedDocset returns the installed version of the docset with the given
+// key, the unpinned one if it's just an id.
+func (d DashRepo) installedDocset(id string) (installedDocset, bool) {
+	installed, err := d.installedDocsets(id)
+	if err != nil || len(installed) == 0 {
+		return installedDocset{}, false
+	}
+	return installed[0], true
+}
+
+func (d DashRepo) BuildFullTextIndex(id string) error {
+	ds, ok := d.installedDocset(id)
+	if !ok {
+		return errors.New("not installed: " + id)
+	}
+	return buildFullTextIndex(ds.path(), fullTextPath(ds.file))
+}
+
+func (d DashRepo) RemoveFullTextIndex(id string) error {
+	ds, ok := d.installedDocset(id)
+	if !ok {
+		return errors.New("not installed: " + id)
+	}
+	return os.Remove(fullTextPath(ds.file))
+}
+
+func (d DashRepo) HasFullTextIndex(id string) bool {
+	ds, ok := d.installedDocset(id)
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(fullTextPath(ds.file))
+	return err == nil
+}
+
+// SearchFullText searches docsets whose id or key is in allowedDocs.
+func (d DashRepo) SearchFullText(ctx context.Context, query string, allowedDocs map[string]bool, limit int) ([]FullTextResult, error) {
+	var res []FullTextResult
+	installed, err := d.installedDocsets("")
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range installed {
+		if len(res) >= limit {
+			break
+		}
+		if allowedDocs != nil && !allowedDocs[ds.item.Id] && !allowedDocs[ds.key()] {
+			continue
+		}
+		ftsFile := fullTextPath(ds.file)
+		if _, err := os.Stat(ftsFile); err != nil {
+			continue
+		}
+		pages, err := searchFullTextFile(ctx, ftsFile, query, limit-len(res))
+		if err != nil {
+			return res, err
+		}
+		for _, page := range pages {
+			// pages are stored under the title
+			path := ds.pathPrefix() + strings.TrimPrefix(page[0], ds.item.Title+".docset")
+			res = append(res, FullTextResult{path, page[1], d.Name(), ds.item.Title, ds.item.Id, ds.version})
+		}
+	}
+	return res, nil
+}
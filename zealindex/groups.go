@@ -0,0 +1,340 @@
+package zealindex
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Group is a user-defined set of docsets to search in.
+type Group struct {
+	Id       string
+	Name     string
+	Icon     string
+	Position int      // groups are listed in ascending order of positions
+	Docsets  []string // ids of member docsets, or keys of single versions, in order
+}
+
+var ErrGroupNotFound = errors.New("group not found")
+
+// migrateGroups moves group members from the comma-separated docs_list
+// column of groups, created lazily by older versions, to group_members.
+func migrateGroups(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS groups (id integer primary key autoincrement, icon, name, docs_list)")
+	if err != nil {
+		return err
+	}
+
+	type oldGroup struct {
+		id, icon, name, docsList string
+	}
+	var old []oldGroup
+	rows, err := tx.Query("SELECT id, icon, name, docs_list FROM groups ORDER BY id")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var g oldGroup
+		var icon, name, docsList sql.NullString
+		if err = rows.Scan(&g.id, &icon, &name, &docsList); err != nil {
+			rows.Close()
+			return err
+		}
+		g.icon, g.name, g.docsList = icon.String, name.String, docsList.String
+		old = append(old, g)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, stmt := range []string{
+		"DROP TABLE groups",
+		"CREATE TABLE groups (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+			"name TEXT NOT NULL, " +
+			"icon TEXT NOT NULL DEFAULT '', " +
+			"position INTEGER NOT NULL)",
+		"CREATE TABLE group_members (" +
+			"group_id INTEGER NOT NULL REFERENCES groups(id) ON DELETE CASCADE, " +
+			"docset_id TEXT NOT NULL, " +
+			"position INTEGER NOT NULL, " +
+			"PRIMARY KEY (group_id, docset_id))",
+	} {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	for i, g := range old {
+		_, err = tx.Exec("INSERT INTO groups (id, name, icon, position) VALUES (?, ?, ?, ?)",
+			g.id, g.name, g.icon, i)
+		if err != nil {
+			return err
+		}
+		if g.docsList == "" {
+			continue
+		}
+		position := 0
+		for _, docset := range strings.Split(g.docsList, ",") {
+			if docset == "" {
+				continue
+			}
+			// docs_list could hold the same docset more than once
+			_, err = tx.Exec("INSERT OR IGNORE INTO group_members (group_id, docset_id, position) VALUES (?, ?, ?)",
+				g.id, docset, position)
+			if err != nil {
+				return err
+			}
+			position++
+		}
+	}
+	return nil
+}
+
+func groupMembers(db *sql.DB, id string) ([]string, error) {
+	res := []string{}
+	rows, err := db.Query("SELECT docset_id FROM group_members WHERE group_id = ? ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var docset string
+		if err = rows.Scan(&docset); err != nil {
+			return nil, err
+		}
+		res = append(res, docset)
+	}
+	return res, rows.Err()
+}
+
+// GetGroups returns all groups, in order.
+func GetGroups() ([]Group, error) {
+	db := GetCacheDB()
+	res := []Group{}
+	rows, err := db.Query("SELECT id, name, icon, position FROM groups ORDER BY position, id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var g Group
+		if err = rows.Scan(&g.Id, &g.Name, &g.Icon, &g.Position); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		res = append(res, g)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range res {
+		if res[i].Docsets, err = groupMembers(db, res[i].Id); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// GetGroup returns the group with the given id, or ErrGroupNotFound.
+func GetGroup(id string) (Group, error) {
+	db := GetCacheDB()
+	var g Group
+	err := db.QueryRow("SELECT id, name, icon, position FROM groups WHERE id = ?", id).
+		Scan(&g.Id, &g.Name, &g.Icon, &g.Position)
+	if err == sql.ErrNoRows {
+		return g, ErrGroupNotFound
+	} else if err != nil {
+		return g, err
+	}
+	g.Docsets, err = groupMembers(db, id)
+	return g, err
+}
+
+// CreateGroup adds an empty group after all existing ones.
+func CreateGroup(name, icon string) (Group, error) {
+	res, err := GetCacheDB().Exec(
+		"INSERT INTO groups (name, icon, position) "+
+			"SELECT ?, ?, COALESCE(MAX(position) + 1, 0) FROM groups",
+		name, icon)
+	if err != nil {
+		return Group{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Group{}, err
+	}
+	return GetGroup(strconv.FormatInt(id, 10))
+}
+
+// UpdateGroup changes the group's name and icon, and moves it to the given
+// position if it changed, shifting the groups in between.
+func UpdateGroup(g Group) error {
+	tx, err := GetCacheDB().Begin()
+	if err != nil {
+		return err
+	}
+	if err = updateGroup(tx, g); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateGroup(tx *sql.Tx, g Group) error {
+	var oldPosition int
+	err := tx.QueryRow("SELECT position FROM groups WHERE id = ?", g.Id).Scan(&oldPosition)
+	if err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if g.Position != oldPosition {
+		ids, err := groupIds(tx)
+		if err != nil {
+			return err
+		}
+		var others []string
+		for _, id := range ids {
+			if id != g.Id {
+				others = append(others, id)
+			}
+		}
+		position := max(0, min(g.Position, len(others)))
+		ids = append(others[:position:position], g.Id)
+		if err = renumberGroups(tx, append(ids, others[position:]...)); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE groups SET name = ?, icon = ? WHERE id = ?", g.Name, g.Icon, g.Id)
+	return err
+}
+
+// groupIds returns the ids of all groups, in order.
+func groupIds(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query("SELECT id FROM groups ORDER BY position, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// renumberGroups sets the positions of the groups to their index in ids.
+func renumberGroups(tx *sql.Tx, ids []string) error {
+	for i, id := range ids {
+		if _, err := tx.Exec("UPDATE groups SET position = ? WHERE id = ?", i, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteGroup removes the group together with its list of members, and
+// closes the gap in the positions.
+func DeleteGroup(id string) error {
+	tx, err := GetCacheDB().Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM groups WHERE id = ?", id)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM group_members WHERE group_id = ?", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return ErrGroupNotFound
+	}
+	ids, err := groupIds(tx)
+	if err == nil {
+		err = renumberGroups(tx, ids)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddGroupMembers appends docsets which aren't members of the group yet.
+func AddGroupMembers(id string, docsets []string) error {
+	tx, err := GetCacheDB().Begin()
+	if err != nil {
+		return err
+	}
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM groups WHERE id = ?", id).Scan(&exists)
+	if err == nil && exists == 0 {
+		err = ErrGroupNotFound
+	}
+	for _, docset := range docsets {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO group_members (group_id, docset_id, position) "+
+				"SELECT ?, ?, COALESCE(MAX(position) + 1, 0) FROM group_members WHERE group_id = ?",
+			id, docset, id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetGroupMembers replaces all members of the group, keeping their order.
+func SetGroupMembers(id string, docsets []string) error {
+	tx, err := GetCacheDB().Begin()
+	if err != nil {
+		return err
+	}
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM groups WHERE id = ?", id).Scan(&exists)
+	if err == nil && exists == 0 {
+		err = ErrGroupNotFound
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM group_members WHERE group_id = ?", id)
+	}
+	for i, docset := range docsets {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT OR IGNORE INTO group_members (group_id, docset_id, position) VALUES (?, ?, ?)",
+			id, docset, i)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveGroupMember removes the docset from the group, returning false if it
+// wasn't a member.  Groups are kept even once they become empty.
+func RemoveGroupMember(id, docset string) (bool, error) {
+	res, err := GetCacheDB().Exec("DELETE FROM group_members WHERE group_id = ? AND docset_id = ?", id, docset)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
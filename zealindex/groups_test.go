@@ -0,0 +1,126 @@
+package zealindex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMigrateGroups(t *testing.T) {
+	tempDataDir(t)
+	writeV0CacheDB(t, cacheDBPath())
+	if err := OpenCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := GetGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Group{
+		{Id: "1", Name: "Web", Icon: "web", Position: 0, Docsets: []string{"2", "1"}},
+		{Id: "3", Name: "Empty", Icon: "", Position: 1, Docsets: []string{}},
+		{Id: "4", Name: "Python", Icon: "py", Position: 2, Docsets: []string{"1"}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("migrated groups %+v, want %+v", groups, want)
+	}
+
+	g, err := CreateGroup("New", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Id != "5" || g.Position != 3 {
+		t.Errorf("group created after migrating has id %s and position %d, want 5 and 3", g.Id, g.Position)
+	}
+}
+
+// testGroups creates groups with the given names and returns their ids.
+func testGroups(t *testing.T, names ...string) []string {
+	var ids []string
+	for _, name := range names {
+		g, err := CreateGroup(name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, g.Id)
+	}
+	return ids
+}
+
+// checkGroupOrder checks that the groups are listed with the given names and
+// numbered from 0 without gaps.
+func checkGroupOrder(t *testing.T, names ...string) {
+	t.Helper()
+	groups, err := GetGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i, g := range groups {
+		got = append(got, g.Name)
+		if g.Position != i {
+			t.Errorf("group %s has position %d, want %d", g.Name, g.Position, i)
+		}
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("groups in order %v, want %v", got, names)
+	}
+}
+
+func TestUpdateGroupReorders(t *testing.T) {
+	testDataDir(t)
+	ids := testGroups(t, "A", "B", "C", "D")
+
+	for _, test := range []struct {
+		id       string
+		name     string
+		position int
+		want     []string
+	}{
+		{ids[3], "D", 1, []string{"A", "D", "B", "C"}},
+		{ids[3], "D", 3, []string{"A", "B", "C", "D"}},
+		{ids[0], "A", 2, []string{"B", "C", "A", "D"}},
+		// renaming keeps the position
+		{ids[0], "E", 2, []string{"B", "C", "E", "D"}},
+		// out of range positions move to the ends
+		{ids[1], "B", 10, []string{"C", "E", "D", "B"}},
+		{ids[1], "B", -1, []string{"B", "C", "E", "D"}},
+	} {
+		if err := UpdateGroup(Group{Id: test.id, Name: test.name, Position: test.position}); err != nil {
+			t.Fatal(err)
+		}
+		checkGroupOrder(t, test.want...)
+	}
+
+	if err := UpdateGroup(Group{Id: "100", Name: "X"}); err != ErrGroupNotFound {
+		t.Errorf("updating a missing group returned %v", err)
+	}
+}
+
+func TestDeleteGroupRenumbers(t *testing.T) {
+	testDataDir(t)
+	ids := testGroups(t, "A", "B", "C", "D")
+	if err := SetGroupMembers(ids[1], []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteGroup(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	checkGroupOrder(t, "A", "C", "D")
+	var members int
+	GetCacheDB().QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ?", ids[1]).Scan(&members)
+	if members != 0 {
+		t.Errorf("%d members of the deleted group were kept", members)
+	}
+
+	if err := DeleteGroup(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	testGroups(t, "E")
+	checkGroupOrder(t, "C", "D", "E")
+
+	if err := DeleteGroup(ids[0]); err != ErrGroupNotFound {
+		t.Errorf("deleting a missing group returned %v", err)
+	}
+}
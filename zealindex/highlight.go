@@ -0,0 +1,79 @@
+package zealindex
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// mungeWithOffsets does the same as Munge, but also returns for every byte of
+// the munged string the range of bytes of s it was produced from.
+func mungeWithOffsets(s string) (string, []int, []int) {
+	var res []byte
+	var starts, ends []int
+	emit := func(b []byte, start, end int) {
+		for _, c := range b {
+			res = append(res, c)
+			starts = append(starts, start)
+			ends = append(ends, end)
+		}
+	}
+
+	buf := make([]byte, utf8.UTFMax)
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case strings.HasPrefix(s[i:], "::"):
+			emit([]byte{'.'}, i, i+2)
+			size = 2
+		case r == ' ' || r == '/':
+			emit([]byte{'.'}, i, i+1)
+		case r == utf8.RuneError && size == 1:
+			// strings.ToLower replaces invalid bytes with U+FFFD
+			n := utf8.EncodeRune(buf, utf8.RuneError)
+			emit(buf[:n], i, i+1)
+		default:
+			n := utf8.EncodeRune(buf, unicode.ToLower(r))
+			emit(buf[:n], i, i+size)
+		}
+		i += size
+	}
+	return string(res), starts, ends
+}
+
+// highlightRanges returns the [start, end) byte ranges of name matching the
+// munged query.  SearchAllDocs only highlights the results it returns, so the
+// name is matched again with the same deterministic matchers, strings.Index
+// and then matchFuzzy, which report the positions they matched.
+func highlightRanges(qMunged, name string) [][2]int {
+	munged, starts, ends := mungeWithOffsets(name)
+
+	var positions []int
+	if i := strings.Index(munged, qMunged); i != -1 {
+		for j := i; j < i+len(qMunged); j++ {
+			positions = append(positions, j)
+		}
+	} else if qMunged != "" {
+		positions = make([]int, len(qMunged))
+		if start, _ := matchFuzzyPositions(qMunged, munged, positions); start == -1 {
+			positions = nil
+		}
+	}
+
+	var res [][2]int
+	for k := 0; k < len(positions); {
+		// merge consecutive positions into a single range
+		l := k
+		for l+1 < len(positions) && positions[l+1] == positions[l]+1 {
+			l++
+		}
+		start, end := starts[positions[k]], ends[positions[l]]
+		if n := len(res); n > 0 && res[n-1][1] >= start {
+			res[n-1][1] = max(res[n-1][1], end)
+		} else {
+			res = append(res, [2]int{start, end})
+		}
+		k = l + 1
+	}
+	return res
+}
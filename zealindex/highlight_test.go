@@ -0,0 +1,75 @@
+package zealindex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHighlightRanges(t *testing.T) {
+	for _, test := range []struct {
+		query, name string
+		want        [][2]int
+	}{
+		// exact matches
+		{"join", "os.path.join", [][2]int{{8, 12}}},
+		{"path", "os.Path.join", [][2]int{{3, 7}}},
+		{"é", "Café", [][2]int{{3, 5}}},
+		// "::", " " and "/" are matched as "."
+		{"std.vec", "std::vector", [][2]int{{0, 8}}},
+		{"vector.push", "std::vector::push_back", [][2]int{{5, 17}}},
+		{"a.b", "a/b", [][2]int{{0, 3}}},
+		{"a.b", "a b", [][2]int{{0, 3}}},
+		// fuzzy matches
+		{"pj", "os.path.join", [][2]int{{3, 4}, {8, 9}}},
+		{"s.v", "std::vector", [][2]int{{0, 1}, {3, 6}}},
+		{"v.p", "std::vector::push_back", [][2]int{{5, 6}, {11, 14}}},
+		// matchFuzzy prefers the match ending the name to the tighter one
+		// at 4 and 6
+		{"ba", "aabxb.a.", [][2]int{{2, 3}, {6, 7}}},
+		// no match
+		{"zz", "os.path.join", nil},
+		{"", "os.path.join", nil},
+	} {
+		if got := highlightRanges(Munge(test.query), test.name); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("highlightRanges(%q, %q) = %v, want %v", test.query, test.name, got, test.want)
+		}
+	}
+}
+
+func TestMungeWithOffsets(t *testing.T) {
+	munged, starts, ends := mungeWithOffsets("A::b c/d")
+	if munged != Munge("A::b c/d") {
+		t.Errorf("munged %q, want %q", munged, Munge("A::b c/d"))
+	}
+	wantStarts := []int{0, 1, 3, 4, 5, 6, 7}
+	wantEnds := []int{1, 3, 4, 5, 6, 7, 8}
+	if !reflect.DeepEqual(starts, wantStarts) || !reflect.DeepEqual(ends, wantEnds) {
+		t.Errorf("offsets %v, %v, want %v, %v", starts, ends, wantStarts, wantEnds)
+	}
+}
+
+func TestFuzzyMatchPositionsAgreeWithMatchFuzzy(t *testing.T) {
+	for _, test := range []struct{ needle, haystack string }{
+		{"pj", "os.path.join"},
+		{"ba", "aabxb.a."},
+		{"ab", "a.xxxxxxab"},
+		{"abc", "xaxbxcxabc"},
+		{"zz", "os.path"},
+	} {
+		positions := make([]int, len(test.needle))
+		start, length := matchFuzzyPositions(test.needle, test.haystack, positions)
+		wantStart, wantLength := matchFuzzy(test.needle, test.haystack)
+		if start != wantStart || length != wantLength {
+			t.Errorf("%q in %q: got %d, %d, matchFuzzy %d, %d", test.needle, test.haystack, start, length, wantStart, wantLength)
+		}
+		if start == -1 {
+			continue
+		}
+		for i, pos := range positions {
+			if test.haystack[pos] != test.needle[i] || i > 0 && pos <= positions[i-1] {
+				t.Errorf("%q in %q: positions %v don't match the needle in order", test.needle, test.haystack, positions)
+				break
+			}
+		}
+	}
+}
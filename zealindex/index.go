@@ -0,0 +1,225 @@
+package zealindex
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// IndexEntry is a single searchable symbol.
+type IndexEntry struct {
+	Name   string
+	Munged string
+	Path   string
+	Type   string
+}
+
+// IndexedDocset describes the docset a segment of the index was imported from.
+type IndexedDocset struct {
+	RepoName string
+	Name     string
+	Id       string
+	Keywords []string // lowercased, used to scope searches with `keyword:query`
+	Aliases  []string // user-defined keywords, see LoadAliases
+	// the installed version, several of which can be indexed side by side
+	Version string
+}
+
+// DocsetKey identifies an installed version of a docset, as "<id>@<version>".
+// The id alone stands for all installed versions.
+func DocsetKey(id, version string) string {
+	if version == "" {
+		return id
+	}
+	return id + "@" + version
+}
+
+// SplitDocsetKey splits a key built by DocsetKey into the id and version.
+func SplitDocsetKey(key string) (string, string) {
+	if at := strings.Index(key, "@"); at >= 0 {
+		return key[:at], key[at+1:]
+	}
+	return key, ""
+}
+
+// Key returns the docset's key, with the version if it has one.
+func (ds IndexedDocset) Key() string {
+	return DocsetKey(ds.Id, ds.Version)
+}
+
+// InScope checks whether allowedDocs, holding ids for all versions of a
+// docset and keys for single versions, includes the docset.  nil allows all
+// docsets.
+func (ds IndexedDocset) InScope(allowedDocs map[string]bool) bool {
+	return allowedDocs == nil || allowedDocs[ds.Id] || allowedDocs[ds.Key()]
+}
+
+// hasKey checks whether the docset has the id of the key and, if the key
+// includes one, its version.
+func (ds IndexedDocset) hasKey(key string) bool {
+	id, version := SplitDocsetKey(key)
+	return ds.Id == id && (version == "" || ds.Version == version)
+}
+
+// IndexSegment holds all entries of a single docset.  Segments are never
+// modified once they are added to the index.
+type IndexSegment struct {
+	Docset  IndexedDocset
+	Entries []IndexEntry
+
+	trigrams *trigramIndex // nil unless the trigram index is enabled
+}
+
+// IndexSnapshot is a stable view of the index, unaffected by docsets being
+// added or removed after it was taken.
+type IndexSnapshot struct {
+	Segments []*IndexSegment
+}
+
+// Len returns the total number of entries in the snapshot.
+func (s IndexSnapshot) Len() int {
+	res := 0
+	for _, seg := range s.Segments {
+		res += len(seg.Entries)
+	}
+	return res
+}
+
+// Iterate calls f for every entry in the snapshot, stopping early when f
+// returns false.
+func (s IndexSnapshot) Iterate(f func(docset IndexedDocset, entry IndexEntry) bool) {
+	for _, seg := range s.Segments {
+		for _, entry := range seg.Entries {
+			if !f(seg.Docset, entry) {
+				return
+			}
+		}
+	}
+}
+
+// GlobalIndex publishes its list of segments through an atomic pointer:
+// writers build a new list off to the side and swap it in, so readers never
+// wait for docsets being installed or removed.
+type GlobalIndex struct {
+	segments  atomic.Value // []*IndexSegment
+	writeLock sync.Mutex   // serializes Add and RemoveDocset
+	trigrams  bool
+	ranking   atomic.Value // Ranking
+	recent    *RecentlyOpened
+}
+
+func NewGlobalIndex() *GlobalIndex {
+	idx := &GlobalIndex{recent: NewRecentlyOpened()}
+	idx.segments.Store([]*IndexSegment{})
+	idx.ranking.Store(Ranking{})
+	return idx
+}
+
+// SetRanking changes how search results are ranked from now on.
+func (idx *GlobalIndex) SetRanking(r Ranking) {
+	idx.ranking.Store(r)
+}
+
+func (idx *GlobalIndex) Ranking() Ranking {
+	return idx.ranking.Load().(Ranking)
+}
+
+// RecordOpened marks the page at path as opened by the user, for ranking
+// boosts of recently used symbols.
+func (idx *GlobalIndex) RecordOpened(path string) {
+	idx.recent.Record(path)
+}
+
+// EnableTrigramIndex makes docsets added from now on build a trigram index
+// alongside their munged names.  It speeds up searching large collections at
+// the cost of memory.
+func (idx *GlobalIndex) EnableTrigramIndex() {
+	idx.writeLock.Lock()
+	idx.trigrams = true
+	idx.writeLock.Unlock()
+}
+
+func (idx *GlobalIndex) loadSegments() []*IndexSegment {
+	return idx.segments.Load().([]*IndexSegment)
+}
+
+// Add adds entries of the given docset to the index, replacing any entries
+// previously added for the same version of the docset.  The entries slice is
+// owned by the index afterwards and must not be modified by the caller.
+func (idx *GlobalIndex) Add(docset IndexedDocset, entries []IndexEntry) {
+	idx.replace(docset.Version, docset, entries)
+}
+
+// replace adds entries like Add, replacing the ones of the docset's
+// oldVersion at the same time, so that searches never miss the docset.
+func (idx *GlobalIndex) replace(oldVersion string, docset IndexedDocset, entries []IndexEntry) {
+	for i := range entries {
+		if entries[i].Munged == "" {
+			entries[i].Munged = Munge(entries[i].Name)
+		}
+	}
+	seg := &IndexSegment{Docset: docset, Entries: entries}
+
+	idx.writeLock.Lock()
+	trigrams := idx.trigrams
+	idx.writeLock.Unlock()
+	if trigrams {
+		// built before taking the lock again, it can take a while
+		seg.trigrams = newTrigramIndex(entries)
+	}
+
+	idx.writeLock.Lock()
+	defer idx.writeLock.Unlock()
+
+	old := idx.loadSegments()
+	segments := make([]*IndexSegment, 0, len(old)+1)
+	for _, s := range old {
+		if s.Docset.RepoName != docset.RepoName || s.Docset.Id != docset.Id ||
+			s.Docset.Version != docset.Version && s.Docset.Version != oldVersion {
+			segments = append(segments, s)
+		}
+	}
+	idx.segments.Store(append(segments, seg))
+}
+
+// RemoveDocset removes all entries of the docset with the given key, of all
+// versions if it's just an id, returning false if it wasn't indexed.
+func (idx *GlobalIndex) RemoveDocset(key string) bool {
+	return idx.remove(func(ds IndexedDocset) bool { return ds.hasKey(key) })
+}
+
+// removeVersion removes the entries of exactly the given version of a
+// docset, also if it's empty.
+func (idx *GlobalIndex) removeVersion(id, version string) bool {
+	return idx.remove(func(ds IndexedDocset) bool { return ds.Id == id && ds.Version == version })
+}
+
+func (idx *GlobalIndex) remove(matches func(IndexedDocset) bool) bool {
+	idx.writeLock.Lock()
+	defer idx.writeLock.Unlock()
+
+	old := idx.loadSegments()
+	segments := make([]*IndexSegment, 0, len(old))
+	for _, seg := range old {
+		if !matches(seg.Docset) {
+			segments = append(segments, seg)
+		}
+	}
+	if len(segments) == len(old) {
+		return false
+	}
+	idx.segments.Store(segments)
+	return true
+}
+
+// Snapshot returns the current contents of the index without taking any
+// locks.  Segment lists are never modified after being published, so the
+// snapshot stays valid for as long as the caller needs it.
+func (idx *GlobalIndex) Snapshot() IndexSnapshot {
+	return IndexSnapshot{idx.loadSegments()}
+}
+
+// Iterate calls f for every entry currently in the index.
+func (idx *GlobalIndex) Iterate(f func(docset IndexedDocset, entry IndexEntry) bool) {
+	idx.Snapshot().Iterate(f)
+}
@@ -0,0 +1,94 @@
+package zealindex
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Bump whenever the layout of cachedIndex or the way rows are imported changes,
+// so that stale caches get rebuilt instead of loaded.
+const indexCacheVersion = 3
+
+// cachedIndex holds the rows imported from a docset's docSet.dsidx, stored in
+// a <title>.zealidx file next to <title>.zealdocset, or the entries of a
+// docbook together with its parsed .devhelp file, stored as
+// <file name>.zealidx in DataDir.  It's only valid as long as the source file
+// keeps the same mtime and size.
+type cachedIndex struct {
+	Version      int
+	ModTime      int64
+	Size         int64
+	Entries      []IndexEntry
+	SymbolCounts map[string]int
+	Docbook      *Docbook // nil for docsets
+}
+
+func indexCachePath(docsetFile string) string {
+	return strings.TrimSuffix(docsetFile, ".zealdocset") + ".zealidx"
+}
+
+func loadCachedIndex(docsetFile string) (*cachedIndex, error) {
+	return loadIndexCache(docsetFile, indexCachePath(docsetFile))
+}
+
+// loadIndexCache reads the cache at path of the index imported from source.
+func loadIndexCache(source, path string) (*cachedIndex, error) {
+	st, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res cachedIndex
+	if err = gob.NewDecoder(f).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Version != indexCacheVersion {
+		return nil, errors.New("index cache version mismatch")
+	}
+	if res.ModTime != st.ModTime().UnixNano() || res.Size != st.Size() {
+		return nil, errors.New("index cache out of date")
+	}
+	return &res, nil
+}
+
+func saveCachedIndex(docsetFile string, c cachedIndex) error {
+	return saveIndexCache(docsetFile, indexCachePath(docsetFile), c)
+}
+
+// saveIndexCache writes the cache of the index imported from source to path.
+func saveIndexCache(source, path string, c cachedIndex) error {
+	st, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	c.Version = indexCacheVersion
+	c.ModTime = st.ModTime().UnixNano()
+	c.Size = st.Size()
+
+	// write to a temporary file first, so that a crash never leaves a
+	// truncated cache behind
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&c)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func removeCachedIndex(docsetFile string) {
+	os.Remove(indexCachePath(docsetFile))
+}
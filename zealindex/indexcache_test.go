@@ -0,0 +1,151 @@
+package zealindex
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testIndexSource writes a file standing in for a docset, with a fixed mtime.
+func testIndexSource(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "Test.zealdocset")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testCachedIndex() cachedIndex {
+	return cachedIndex{
+		Entries:      []IndexEntry{{Name: "os.path.join", Munged: Munge("os.path.join"), Path: "library/os.path.html#os.path.join", Type: "Function"}},
+		SymbolCounts: map[string]int{"Function": 1},
+	}
+}
+
+func TestIndexCacheHit(t *testing.T) {
+	source := testIndexSource(t, "docset")
+	want := testCachedIndex()
+	if err := saveCachedIndex(source, want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(source), "Test.zealidx")); err != nil {
+		t.Error("cache not saved next to the docset:", err)
+	}
+
+	got, err := loadCachedIndex(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Entries, want.Entries) || !reflect.DeepEqual(got.SymbolCounts, want.SymbolCounts) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+}
+
+func TestIndexCacheInvalidation(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(t *testing.T, source string)
+	}{
+		{"size", func(t *testing.T, source string) {
+			st, _ := os.Stat(source)
+			if err := os.WriteFile(source, []byte("a larger docset"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			// only the size differs
+			os.Chtimes(source, st.ModTime(), st.ModTime())
+		}},
+		{"mtime", func(t *testing.T, source string) {
+			mtime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+			if err := os.Chtimes(source, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"version", func(t *testing.T, source string) {
+			st, _ := os.Stat(source)
+			stale := testCachedIndex()
+			stale.Version, stale.ModTime, stale.Size = indexCacheVersion-1, st.ModTime().UnixNano(), st.Size()
+			f, err := os.Create(indexCachePath(source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err = gob.NewEncoder(f).Encode(&stale); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"removed cache", func(t *testing.T, source string) {
+			removeCachedIndex(source)
+		}},
+	} {
+		source := testIndexSource(t, "docset")
+		if err := saveCachedIndex(source, testCachedIndex()); err != nil {
+			t.Fatal(err)
+		}
+		test.change(t, source)
+		if _, err := loadCachedIndex(source); err == nil {
+			t.Errorf("cache loaded after changing the %s", test.name)
+		}
+	}
+}
+
+const testDevhelp = `<?xml version="1.0"?>
+<book xmlns="http://www.devhelp.net/book" title="GLib Reference Manual" name="glib" link="index.html" language="c">
+  <chapters>
+    <sub name="Arrays" link="glib-Arrays.html"/>
+  </chapters>
+  <functions>
+    <keyword type="function" name="g_array_new ()" link="glib-Arrays.html#g-array-new"/>
+    <keyword type="struct" name="GArray" link="glib-Arrays.html#GArray"/>
+  </functions>
+</book>
+`
+
+func TestDocbookIndexCache(t *testing.T) {
+	tempDataDir(t)
+	file := filepath.Join(t.TempDir(), "glib.devhelp2")
+	if err := os.WriteFile(file, []byte(testDevhelp), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(file, mtime, mtime)
+
+	db, entries, counts, err := loadIndexedDocBook(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Name != "glib" || len(db.Chapters) != 1 || len(entries) != 2 || counts["Function"] != 1 {
+		t.Fatalf("loaded %+v with entries %+v and counts %v", db, entries, counts)
+	}
+	if _, err = os.Stat(filepath.Join(DataDir, "glib.devhelp2.zealidx")); err != nil {
+		t.Error("cache not saved in DataDir:", err)
+	}
+
+	// with the same mtime and size the broken file isn't parsed again
+	broken := make([]byte, len(testDevhelp))
+	if err = os.WriteFile(file, broken, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, mtime, mtime)
+	cachedDb, cachedEntries, cachedCounts, err := loadIndexedDocBook(file)
+	if err != nil {
+		t.Fatal("cache not used:", err)
+	}
+	if !reflect.DeepEqual(cachedDb, db) || !reflect.DeepEqual(cachedEntries, entries) || !reflect.DeepEqual(cachedCounts, counts) {
+		t.Errorf("loaded %+v with entries %+v and counts %v from the cache, want %+v, %+v, %v",
+			cachedDb, cachedEntries, cachedCounts, db, entries, counts)
+	}
+
+	// but once it changes it is
+	mtime = mtime.Add(time.Hour)
+	os.Chtimes(file, mtime, mtime)
+	if _, _, _, err = loadIndexedDocBook(file); err == nil {
+		t.Error("changed docbook loaded from the cache")
+	}
+}
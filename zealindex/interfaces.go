@@ -1,7 +1,10 @@
 package zealindex
 
 import (
+	"context"
 	"io"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -23,6 +26,20 @@ type RepoItem struct {
 	Archive         string
 	ContribRepoKey  string
 	SymbolCounts    map[string]int
+	// size and SHA-256 checksum of the latest version's archive, verified
+	// after downloading it if the feed lists them.  Neither api.zealdocs.org
+	// nor the Kapeli contrib mirrors do, so their archives are only checked
+	// against the length the server sends.
+	ArchiveSize     int64
+	ArchiveSha256   string
+	// set for installed docsets with a newer revision in the feed
+	UpdateAvailable bool
+	// archives of older versions by version, for feeds listing them
+	VersionArchives map[string]string
+	// the installed version of installed docsets.  When installing, the
+	// version to pin, or empty for the latest one.
+	Version         string
+	Pinned          bool // installed at a specific version, never updated
 }
 
 type ProgressHandlers struct {
@@ -34,16 +51,44 @@ func NewProgressHandlers() ProgressHandlers {
 	return ProgressHandlers{make(map[int]func(string, string, int64, int64)), sync.RWMutex{}}
 }
 
+func (h *ProgressHandlers) report(repoId, docset string, received, total int64) {
+	h.Lock.RLock()
+	for _, v := range h.Map {
+		v(repoId, docset, received, total)
+	}
+	h.Lock.RUnlock()
+}
+
+// ImportError is returned by ImportAll for docsets which failed to load and
+// were skipped, by file or docset name.  The others are imported regardless.
+type ImportError map[string]error
+
+func (e ImportError) Error() string {
+	var names []string
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var msgs []string
+	for _, name := range names {
+		msgs = append(msgs, name+": "+e[name].Error())
+	}
+	return "skipped docsets: " + strings.Join(msgs, "; ")
+}
+
+// DocsRepo is a source of docsets.  Installs are run as jobs by a JobManager,
+// and return once the docset is installed, but not yet indexed.
 type DocsRepo interface {
 	Name() string
-	ImportAll(idx GlobalIndex)
-	GetInstalled() []RepoItem
+	ImportAll(idx *GlobalIndex) error
+	GetInstalled() ([]RepoItem, error)
 	GetAvailableForInstall() ([]RepoItem, error)
-	StartDocsetInstallById(id string, handlers ProgressHandlers, completed func()) string
-	StartDocsetInstallByIo(iostream io.ReadCloser, repoItem RepoItem, len int64, handlers ProgressHandlers, completed func()) string
-	GetSymbols(idx GlobalIndex, id, tp string) [][]string
-	GetChapters(id, path string) [][]string
+	GetAvailableItem(id string) (RepoItem, bool)
+	InstallDocset(ctx context.Context, item RepoItem, job *RunningJob) error
+	InstallDocsetFromIo(ctx context.Context, iostream io.Reader, repoItem RepoItem, len int64, job *RunningJob) error
+	GetSymbols(idx *GlobalIndex, id, tp string) [][]string
+	GetChapters(id, path string) ([][]string, error)
 	GetPage(path string, w io.Writer) error
-	RemoveDocset(id string, idx GlobalIndex) bool
-	IndexDocById(idx GlobalIndex, id string)
+	RemoveDocset(id string, idx *GlobalIndex) bool
+	IndexDocById(idx *GlobalIndex, id string) error
 }
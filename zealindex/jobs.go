@@ -0,0 +1,300 @@
+package zealindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobQueued      JobState = "queued"
+	JobDownloading JobState = "downloading"
+	JobExtracting  JobState = "extracting"
+	JobIndexing    JobState = "indexing"
+	JobRemoving    JobState = "removing"
+	JobDone        JobState = "done"
+	JobFailed      JobState = "failed"
+)
+
+// Kinds of jobs.
+const (
+	JobInstall = "install"
+	JobUpdate  = "update"
+	JobRemove  = "remove"
+)
+
+// Job is a snapshot of an install, update or removal of a docset.
+type Job struct {
+	Id       string
+	Kind     string
+	Repo     string
+	DocsetId string
+	Docset   string // name, if known
+	State    JobState
+	Error    string `json:",omitempty"` // why the job failed
+	Received int64  // progress of the current state, in bytes
+	Total    int64  // -1 if unknown
+	Created  time.Time
+}
+
+func (j Job) finished() bool {
+	return j.State == JobDone || j.State == JobFailed
+}
+
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobFinished  = errors.New("job already finished")
+	ErrJobCancelled = errors.New("cancelled")
+	ErrShuttingDown = errors.New("shutting down")
+)
+
+// How many finished jobs are kept for GET /jobs.
+const maxFinishedJobs = 100
+
+type managedJob struct {
+	Job
+	size   int64 // largest total reported, for reporting 100% when done
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// JobManager runs jobs in the background, at most a limited number of
+// installs and updates at once.  Removals are quick, so they don't wait for
+// a slot.  Progress is also reported to the download progress handlers.
+type JobManager struct {
+	lock     sync.Mutex
+	jobs     map[string]*managedJob
+	order    []string // ids, oldest first
+	lastId   int
+	slots    chan struct{}
+	handlers *ProgressHandlers
+	closing  bool // set by Shutdown, new jobs fail right away
+}
+
+func NewJobManager(maxRunning int, handlers *ProgressHandlers) *JobManager {
+	if maxRunning < 1 {
+		maxRunning = 1
+	}
+	return &JobManager{
+		jobs:     make(map[string]*managedJob),
+		slots:    make(chan struct{}, maxRunning),
+		handlers: handlers,
+	}
+}
+
+// RunningJob is passed to job functions to report their progress.
+type RunningJob struct {
+	m  *JobManager
+	id string
+}
+
+func (j *RunningJob) SetState(state JobState) {
+	j.m.update(j.id, func(job *managedJob) {
+		job.State = state
+		job.Received = 0
+		job.Total = -1
+	})
+}
+
+func (j *RunningJob) SetProgress(received, total int64) {
+	var job Job
+	j.m.update(j.id, func(cur *managedJob) {
+		cur.Received = received
+		cur.Total = total
+		if total > cur.size {
+			cur.size = total
+		}
+		job = cur.Job
+	})
+	if total > 0 && received >= total {
+		received = total - 1 // 100% is only reported once the job is done
+	}
+	j.m.handlers.report(job.Repo, job.Docset, received, total)
+}
+
+// Submit queues a job of the given kind, which run performs, unless the same
+// job is queued or running already, which is returned instead.  Jobs are
+// cancelled through run's ctx.  After Shutdown, jobs fail without running.
+func (m *JobManager) Submit(kind, repo, docsetId, docset string, run func(ctx context.Context, job *RunningJob) error) Job {
+	m.lock.Lock()
+	for _, id := range m.order {
+		j := m.jobs[id]
+		if !j.finished() && j.Kind == kind && j.Repo == repo && j.DocsetId == docsetId {
+			m.lock.Unlock()
+			return j.Job
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.lastId += 1
+	j := &managedJob{
+		Job{strconv.Itoa(m.lastId), kind, repo, docsetId, docset, JobQueued, "", 0, -1, time.Now()},
+		0,
+		cancel,
+		make(chan struct{}),
+	}
+	m.jobs[j.Id] = j
+	m.order = append(m.order, j.Id)
+	m.pruneLocked()
+	res := j.Job
+	closing := m.closing
+	m.lock.Unlock()
+
+	if closing {
+		cancel()
+		m.finish(j.Id, ErrShuttingDown)
+		close(j.done)
+		res.State, res.Error = JobFailed, ErrShuttingDown.Error()
+		return res
+	}
+	installs.Add(1)
+	go (func() {
+		defer installs.Done()
+		defer close(j.done)
+		defer cancel()
+		if kind != JobRemove {
+			select {
+			case m.slots <- struct{}{}:
+				defer (func() { <-m.slots })()
+			case <-ctx.Done():
+				m.finish(j.Id, ErrJobCancelled)
+				return
+			}
+			if ctx.Err() != nil {
+				// cancelled while a slot became free
+				m.finish(j.Id, ErrJobCancelled)
+				return
+			}
+		}
+		err := run(ctx, &RunningJob{m, j.Id})
+		if err != nil && ctx.Err() != nil {
+			err = ErrJobCancelled
+		}
+		m.finish(j.Id, err)
+	})()
+	return res
+}
+
+func (m *JobManager) update(id string, f func(*managedJob)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		f(j)
+	}
+}
+
+func (m *JobManager) finish(id string, err error) {
+	var job Job
+	var size int64
+	m.update(id, func(cur *managedJob) {
+		if err != nil {
+			cur.State = JobFailed
+			cur.Error = err.Error()
+		} else {
+			cur.State = JobDone
+		}
+		job, size = cur.Job, cur.size
+	})
+	if err != nil {
+		fmt.Println(job.Kind + " of " + job.Docset + " failed: " + err.Error())
+	} else if job.Kind != JobRemove {
+		m.handlers.report(job.Repo, job.Docset, size, size)
+	}
+}
+
+// pruneLocked forgets the oldest finished jobs beyond maxFinishedJobs.
+func (m *JobManager) pruneLocked() {
+	finished := 0
+	for _, id := range m.order {
+		if m.jobs[id].finished() {
+			finished++
+		}
+	}
+	var kept []string
+	for _, id := range m.order {
+		if finished > maxFinishedJobs && m.jobs[id].finished() {
+			delete(m.jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	m.order = kept
+}
+
+// Jobs returns all running and queued jobs, and recently finished ones,
+// oldest first.
+func (m *JobManager) Jobs() []Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := []Job{}
+	for _, id := range m.order {
+		res = append(res, m.jobs[id].Job)
+	}
+	return res
+}
+
+func (m *JobManager) Get(id string) (Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return j.Job, nil
+}
+
+// Cancel stops a queued or running job.  Files it was writing are removed
+// before it's marked as failed.
+func (m *JobManager) Cancel(id string) error {
+	m.lock.Lock()
+	j, ok := m.jobs[id]
+	if ok && j.finished() {
+		m.lock.Unlock()
+		return ErrJobFinished
+	}
+	m.lock.Unlock()
+	if !ok {
+		return ErrJobNotFound
+	}
+	j.cancel()
+	return nil
+}
+
+// Shutdown cancels all queued and running jobs, and makes jobs submitted
+// later fail, so that nothing writes to DataDir once the running ones have
+// been waited for.
+func (m *JobManager) Shutdown() {
+	m.lock.Lock()
+	m.closing = true
+	var running []*managedJob
+	for _, id := range m.order {
+		if j := m.jobs[id]; !j.finished() {
+			running = append(running, j)
+		}
+	}
+	m.lock.Unlock()
+	for _, j := range running {
+		j.cancel()
+	}
+}
+
+// Wait waits for the job to finish, returning its final state.
+func (m *JobManager) Wait(ctx context.Context, id string) (Job, error) {
+	m.lock.Lock()
+	j, ok := m.jobs[id]
+	m.lock.Unlock()
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	select {
+	case <-j.done:
+		return m.Get(id)
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	}
+}
@@ -0,0 +1,61 @@
+package zealindex
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// installs tracks docset installs running in the background, so that they
+// can be waited for on shutdown.
+var installs sync.WaitGroup
+
+// Docsets are extracted to <title>.zealdocset.part and only renamed once
+// complete, so that an interrupted install never leaves a truncated docset.
+func partPath(path string) string {
+	return path + ".part"
+}
+
+// TempDir is where temporary files are kept while installing or indexing
+// docsets.  Anything left there is removed by CleanupPartialFiles.
+func TempDir() string {
+	return dataPath("tmp")
+}
+
+// CleanupPartialFiles rolls back installs and indexing interrupted by a crash
+// or shutdown, by removing the files they left behind.
+func CleanupPartialFiles() {
+	for _, pattern := range []string{"*.zealdocset.part*", "*.zealdocset.update*", "*.zealfts.tmp*", "*.zealidx.tmp"} {
+		matches, _ := filepath.Glob(filepath.Join(DataDir, pattern))
+		for _, path := range matches {
+			os.Remove(path)
+		}
+	}
+	os.RemoveAll(TempDir())
+	os.MkdirAll(TempDir(), 0700)
+}
+
+// WaitForInstalls waits for running installs to complete, returning false if
+// ctx is done first.
+func WaitForInstalls(ctx context.Context) bool {
+	done := make(chan struct{})
+	go (func() {
+		installs.Wait()
+		close(done)
+	})()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// CloseCacheDB closes the cache DB; it must not be used afterwards.
+func CloseCacheDB() error {
+	if cache == nil {
+		return nil
+	}
+	return cache.Close()
+}
@@ -0,0 +1,44 @@
+package zealindex
+
+import (
+	"path/filepath"
+)
+
+// DataDir is where installed docsets, their indices and the cache DB are
+// stored.  It should be set to an absolute path before any repo is created.
+var DataDir = "."
+
+func dataPath(name string) string {
+	return filepath.Join(DataDir, name)
+}
+
+func docsetPath(title string) string {
+	return dataPath(title + ".zealdocset")
+}
+
+// FeedURLs configures where docset lists and archives are downloaded from.
+type FeedURLs struct {
+	Dash         string   // JSON list of Dash docsets
+	DashDownload string   // prefix of Dash docset archives, followed by "<name>/latest" or "<name>/<version>"
+	DashMirrors  []string // Kapeli mirrors of Dash docset archives, tried in turn from a random one if DashDownload fails
+	Contrib      []string // mirrors of user contributed docsets, one picked randomly per request
+}
+
+var DefaultFeeds = FeedURLs{
+	"http://api.zealdocs.org/v1/docsets",
+	"https://go.zealdocs.org/d/com.kapeli/",
+	[]string{
+		"https://sanfrancisco.kapeli.com/feeds/",
+		"https://newyork.kapeli.com/feeds/",
+		"https://london.kapeli.com/feeds/",
+		"https://frankfurt.kapeli.com/feeds/",
+	},
+	[]string{
+		"https://sanfrancisco.kapeli.com/feeds/zzz/user_contributed/build/",
+		"https://newyork.kapeli.com/feeds/zzz/user_contributed/build/",
+		"https://london.kapeli.com/feeds/zzz/user_contributed/build/",
+		"https://frankfurt.kapeli.com/feeds/zzz/user_contributed/build/",
+	},
+}
+
+var Feeds = DefaultFeeds
@@ -2,19 +2,217 @@ package zealindex
 
 import (
 	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"strconv"
 )
 
 var cache *sql.DB
 
-func GetCacheDB() *sql.DB {
+func cacheDBPath() string {
+	return dataPath("zealcore_cache.sqlite3")
+}
+
+// migration upgrades the cache DB schema from version-1 to version.
+// Existing migrations must never be changed, only new ones appended.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "group members in group_members", migrateGroups},
+	{2, "typed columns and indices", migrateTypedColumns},
+	{3, "installed versions and revisions", migrateInstalledRevisions},
+	{4, "several installed versions", migrateInstalledFiles},
+}
+
+const schemaVersionKey = "schema_version"
+
+// OpenCacheDB opens the cache DB and brings its schema up to date.  It must
+// be called before repos are created; GetCacheDB returns the opened DB.
+func OpenCacheDB() error {
 	if cache != nil {
-		return cache
-	}
-	var err error
-	cache, err = sql.Open("sqlite3", "zealcore_cache.sqlite3")
-	check(err)
-	cache.Exec("CREATE TABLE IF NOT EXISTS kv (key, value)")
-	cache.Exec("CREATE TABLE IF NOT EXISTS installed_docs (available_doc_id)")
-	cache.Exec("CREATE TABLE IF NOT EXISTS available_docs (id integer primary key autoincrement, repo_id, name, json)")
+		return nil
+	}
+	info, err := os.Stat(cacheDBPath())
+	existed := err == nil && info.Size() > 0
+
+	db, err := sql.Open("sqlite3", cacheDBPath())
+	if err != nil {
+		return err
+	}
+	// the schema before versioning was introduced, upgraded by migrations
+	for _, stmt := range []string{
+		"CREATE TABLE IF NOT EXISTS kv (key, value)",
+		"CREATE TABLE IF NOT EXISTS installed_docs (available_doc_id)",
+		"CREATE TABLE IF NOT EXISTS available_docs (id integer primary key autoincrement, repo_id, name, json)",
+		"CREATE TABLE IF NOT EXISTS docset_aliases (repo, docset_id, alias)",
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return errors.New("cannot open " + cacheDBPath() + ": " + err.Error())
+		}
+	}
+	if err = migrate(db, existed); err != nil {
+		db.Close()
+		return errors.New("cannot migrate " + cacheDBPath() + ": " + err.Error())
+	}
+	cache = db
+	return nil
+}
+
+// GetCacheDB returns the DB opened by OpenCacheDB.
+func GetCacheDB() *sql.DB {
+	if cache == nil {
+		panic("cache DB used before OpenCacheDB")
+	}
 	return cache
 }
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM kv WHERE key = ?", schemaVersionKey).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// backupCacheDB copies the DB file to zealcore_cache.sqlite3.v<version>.bak.
+func backupCacheDB(version int) error {
+	src, err := os.Open(cacheDBPath())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	backupPath := cacheDBPath() + ".v" + strconv.Itoa(version) + ".bak"
+	dst, err := os.Create(backupPath + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(backupPath + ".tmp")
+		return err
+	}
+	return os.Rename(backupPath+".tmp", backupPath)
+}
+
+// migrate runs all migrations newer than the DB's schema version, each in
+// its own transaction together with the version update, so that a failed
+// migration leaves the DB at the previous version.  Existing DBs are backed up
+// first.
+func migrate(db *sql.DB, existed bool) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return errors.New("cache DB schema version " + strconv.Itoa(version) + " is newer than supported")
+	}
+	if version == len(migrations) {
+		return nil
+	}
+	if existed {
+		if err = backupCacheDB(version); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range migrations[version:] {
+		if m.version != version+1 {
+			return errors.New("migration " + m.name + " is out of order")
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = m.up(tx); err == nil {
+			_, err = tx.Exec("DELETE FROM kv WHERE key = ?", schemaVersionKey)
+		}
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO kv (key, value) VALUES (?, ?)",
+				schemaVersionKey, strconv.Itoa(m.version))
+		}
+		if err != nil {
+			tx.Rollback()
+			return errors.New("migration " + m.name + " failed: " + err.Error())
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		version = m.version
+	}
+	return nil
+}
+
+// rebuildTable replaces a table with one created by createStmt, copying all
+// rows with copyStmt, as SQLite can't change the types of existing columns.
+func rebuildTable(tx *sql.Tx, table, createStmt, copyStmt string) error {
+	stmts := []string{
+		"ALTER TABLE " + table + " RENAME TO " + table + "_old",
+		createStmt,
+		copyStmt,
+		"DROP TABLE " + table + "_old",
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateTypedColumns(tx *sql.Tx) error {
+	err := rebuildTable(tx, "kv",
+		"CREATE TABLE kv (key TEXT PRIMARY KEY, value BLOB)",
+		// keep the most recent value of duplicated keys
+		"INSERT OR REPLACE INTO kv (key, value) SELECT key, value FROM kv_old ORDER BY rowid")
+	if err == nil {
+		err = rebuildTable(tx, "available_docs",
+			"CREATE TABLE available_docs ("+
+				"id INTEGER PRIMARY KEY AUTOINCREMENT, "+
+				"repo_id INTEGER NOT NULL, "+
+				"name TEXT NOT NULL, "+
+				"json BLOB)",
+			"INSERT INTO available_docs (id, repo_id, name, json) "+
+				"SELECT id, repo_id, COALESCE(name, ''), json FROM available_docs_old")
+	}
+	if err == nil {
+		err = rebuildTable(tx, "installed_docs",
+			"CREATE TABLE installed_docs ("+
+				"available_doc_id INTEGER NOT NULL REFERENCES available_docs(id))",
+			"INSERT INTO installed_docs (available_doc_id) "+
+				"SELECT DISTINCT available_doc_id FROM installed_docs_old WHERE available_doc_id IS NOT NULL")
+	}
+	if err == nil {
+		err = rebuildTable(tx, "docset_aliases",
+			"CREATE TABLE docset_aliases ("+
+				"repo TEXT NOT NULL, "+
+				"docset_id TEXT NOT NULL, "+
+				"alias TEXT NOT NULL)",
+			"INSERT INTO docset_aliases (repo, docset_id, alias) "+
+				"SELECT repo, docset_id, alias FROM docset_aliases_old ORDER BY rowid")
+	}
+	for _, stmt := range []string{
+		"CREATE INDEX available_docs_name ON available_docs (name)",
+		"CREATE INDEX available_docs_repo_id ON available_docs (repo_id)",
+		"CREATE INDEX installed_docs_available_doc_id ON installed_docs (available_doc_id)",
+		"CREATE INDEX docset_aliases_docset ON docset_aliases (repo, docset_id)",
+	} {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(stmt)
+	}
+	return err
+}
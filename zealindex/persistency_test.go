@@ -0,0 +1,214 @@
+package zealindex
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// tempDataDir points DataDir at a new temporary directory, restoring the
+// previous one and closing the cache DB after the test.
+func tempDataDir(t *testing.T) {
+	oldDataDir := DataDir
+	DataDir = t.TempDir()
+	t.Cleanup(func() {
+		CloseCacheDB()
+		cache = nil
+		DataDir = oldDataDir
+	})
+}
+
+// testDataDir is tempDataDir with an empty cache DB.
+func testDataDir(t *testing.T) {
+	tempDataDir(t)
+	if err := OpenCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	CleanupPartialFiles()
+}
+
+// writeV0CacheDB creates a cache DB at path with the schema and data of the
+// versions before schema versions were introduced.
+func writeV0CacheDB(t *testing.T, path string) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE kv (key, value)",
+		"CREATE TABLE installed_docs (available_doc_id)",
+		"CREATE TABLE available_docs (id integer primary key autoincrement, repo_id, name, json)",
+		"CREATE TABLE docset_aliases (repo, docset_id, alias)",
+		"CREATE TABLE groups (id integer primary key autoincrement, icon, name, docs_list)",
+		`INSERT INTO available_docs (id, repo_id, name, json) VALUES
+			(1, 1, 'Python_3', '{"SourceId": "com.kapeli", "Name": "Python_3", "Title": "Python 3", "Versions": ["3.12", "3.11"], "Revision": "4"}'),
+			(2, 2, 'Lodash', '{"SourceId": "com.kapeli.contrib", "Name": "Lodash", "Title": "Lodash", "Versions": ["4.17"]}'),
+			(3, 2, NULL, '{}')`,
+		// reinstalling Lodash added it twice
+		"INSERT INTO installed_docs (available_doc_id) VALUES (1), (2), (2), (NULL)",
+		// the ranking was saved twice, the later value counts
+		`INSERT INTO kv (key, value) VALUES ('ranking', '{"RecentBoost": 1}'), ('feed:com.kapeli', '{}'), ('ranking', '{"RecentBoost": 2}')`,
+		"INSERT INTO docset_aliases (repo, docset_id, alias) VALUES ('com.kapeli', '1', 'py')",
+		"INSERT INTO groups (id, icon, name, docs_list) VALUES (1, 'web', 'Web', '2,1,2,'), (3, NULL, 'Empty', NULL), (4, 'py', 'Python', '1')",
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(stmt + ": " + err.Error())
+		}
+	}
+}
+
+func openRawDB(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(db *sql.DB, table string) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0
+}
+
+func TestMigrateFreshCacheDB(t *testing.T) {
+	testDataDir(t)
+	if version, err := schemaVersion(GetCacheDB()); err != nil || version != len(migrations) {
+		t.Errorf("schema version %d, error %v, want %d", version, err, len(migrations))
+	}
+	if backups, _ := filepath.Glob(cacheDBPath() + ".v*.bak"); len(backups) > 0 {
+		t.Errorf("new DB was backed up to %v", backups)
+	}
+}
+
+func TestMigrateUnversionedCacheDB(t *testing.T) {
+	tempDataDir(t)
+	writeV0CacheDB(t, cacheDBPath())
+	if err := OpenCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	db := GetCacheDB()
+	if version, err := schemaVersion(db); err != nil || version != len(migrations) {
+		t.Errorf("schema version %d, error %v, want %d", version, err, len(migrations))
+	}
+
+	// the backup is the DB as it was before migrating
+	backup := openRawDB(t, cacheDBPath()+".v0.bak")
+	if version, err := schemaVersion(backup); err != nil || version != 0 {
+		t.Errorf("backup has schema version %d, error %v", version, err)
+	}
+	var docsList string
+	if err := backup.QueryRow("SELECT docs_list FROM groups WHERE id = 1").Scan(&docsList); err != nil || docsList != "2,1,2," {
+		t.Errorf("backup has docs_list %q, error %v", docsList, err)
+	}
+
+	// kv keys are unique, keeping the latest value
+	if r := LoadRanking(); r.RecentBoost != 2 {
+		t.Errorf("ranking has RecentBoost %d, want 2", r.RecentBoost)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM kv WHERE key = 'ranking'").Scan(&count)
+	if count != 1 {
+		t.Errorf("%d rankings in kv", count)
+	}
+
+	type installed struct {
+		id                      int
+		version, revision, file string
+		pinned                  bool
+	}
+	var got []installed
+	rows, err := db.Query("SELECT available_doc_id, version, revision, file, pinned FROM installed_docs ORDER BY available_doc_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i installed
+		if err = rows.Scan(&i.id, &i.version, &i.revision, &i.file, &i.pinned); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, i)
+	}
+	want := []installed{{1, "3.12", "4", "Python 3", false}, {2, "4.17", "", "Lodash", false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("installed docs %v, want %v", got, want)
+	}
+
+	var name string
+	if err = db.QueryRow("SELECT name FROM available_docs WHERE id = 3").Scan(&name); err != nil || name != "" {
+		t.Errorf("NULL name migrated to %q, error %v", name, err)
+	}
+	var alias string
+	if err = db.QueryRow("SELECT alias FROM docset_aliases WHERE repo = 'com.kapeli' AND docset_id = '1'").Scan(&alias); err != nil || alias != "py" {
+		t.Errorf("alias %q, error %v", alias, err)
+	}
+}
+
+func TestMigrateRollsBackFailedMigration(t *testing.T) {
+	tempDataDir(t)
+	writeV0CacheDB(t, cacheDBPath())
+	allMigrations := migrations
+	defer (func() { migrations = allMigrations })()
+	migrations = append(migrations[:2:2], migration{3, "failing", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("CREATE TABLE half_done (x)"); err != nil {
+			return err
+		}
+		return errors.New("no space left")
+	}})
+
+	err := OpenCacheDB()
+	if err == nil || cache != nil {
+		t.Fatal("opened the DB although a migration failed")
+	}
+	db := openRawDB(t, cacheDBPath())
+	if version, err := schemaVersion(db); err != nil || version != 2 {
+		t.Errorf("schema version %d, error %v, want 2, the one before the failed migration", version, err)
+	}
+	if tableExists(db, "half_done") {
+		t.Error("changes of the failed migration were kept")
+	}
+	if !tableExists(db, "group_members") {
+		t.Error("migrations before the failed one were rolled back")
+	}
+
+	// migrating continues from there
+	migrations = allMigrations
+	if err = OpenCacheDB(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := schemaVersion(GetCacheDB()); err != nil || version != len(migrations) {
+		t.Errorf("schema version %d, error %v, want %d", version, err, len(migrations))
+	}
+	for _, version := range []int{0, 2} {
+		if _, err = os.Stat(cacheDBPath() + ".v" + strconv.Itoa(version) + ".bak"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	tempDataDir(t)
+	db := openRawDB(t, cacheDBPath())
+	newer := strconv.Itoa(len(migrations) + 1)
+	if _, err := db.Exec("CREATE TABLE kv (key, value)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO kv (key, value) VALUES (?, ?)", schemaVersionKey, newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenCacheDB(); err == nil {
+		t.Fatal("opened a DB with a newer schema")
+	}
+	if version, _ := schemaVersion(db); version != len(migrations)+1 {
+		t.Errorf("schema version changed to %d", version)
+	}
+}
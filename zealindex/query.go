@@ -0,0 +1,142 @@
+package zealindex
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const DefaultResultLimit = 100
+
+// Query is a parsed search query, like `python:os.path type:Function limit:20`.
+type Query struct {
+	Text    string
+	Docsets []string // lowercased docset names or keywords to search in
+	Types   []string // normalized type names, as returned by MapType
+	Limit   int
+	Offset  int // number of best results to skip, for pagination
+	// merge results with the same name and type, like the same symbol from
+	// different docsets or anchors, into one with alternates
+	Collapse bool
+	// directives which couldn't be parsed, like `limit:0`, left out of Text
+	Invalid []string
+}
+
+// ParseQuery understands the following syntax:
+//
+//	docset:text     - search only in docsets with this name, keyword or alias,
+//	                  several can be given separated with commas
+//	node.js:text    - names with dots only if isDocset knows them, so that
+//	                  `os.path:join` stays text
+//	docset@1.2:text - search only in version 1.2 of the docset
+//	type:Method     - return only symbols of the given type(s)
+//	limit:N         - return at most N results
+//
+// Anything else is the text to search for.  Directives without a valid value
+// are collected in Invalid.  isDocset can be nil, then names with dots are
+// never scopes.
+func ParseQuery(s string, isDocset func(name string) bool) Query {
+	res := Query{Limit: DefaultResultLimit}
+
+	var text []string
+	for _, word := range strings.Fields(s) {
+		lower := strings.ToLower(word)
+		if strings.HasPrefix(lower, "type:") {
+			var types []string
+			for _, tp := range strings.Split(word[5:], ",") {
+				if tp != "" {
+					types = append(types, MapType(tp))
+				}
+			}
+			if len(types) == 0 {
+				res.Invalid = append(res.Invalid, word)
+			}
+			res.Types = append(res.Types, types...)
+		} else if strings.HasPrefix(lower, "limit:") {
+			limit, err := strconv.Atoi(word[6:])
+			if err == nil && limit > 0 {
+				res.Limit = limit
+			} else {
+				res.Invalid = append(res.Invalid, word)
+			}
+		} else {
+			text = append(text, word)
+		}
+	}
+	res.Text = strings.Join(text, " ")
+
+	// `python:os.path`, but not `std::vector`
+	colon := strings.Index(res.Text, ":")
+	if colon > 0 && !strings.HasPrefix(res.Text[colon:], "::") {
+		prefix := res.Text[:colon]
+		// versions can contain dots, names only if they are known
+		scoped := !strings.Contains(prefix, " ")
+		for _, ds := range strings.Split(prefix, ",") {
+			name, _ := SplitDocsetKey(ds)
+			if strings.Contains(name, ".") {
+				scoped = scoped && isDocset != nil && isDocset(ds)
+			}
+		}
+		if scoped {
+			for _, ds := range strings.Split(strings.ToLower(prefix), ",") {
+				if ds != "" {
+					res.Docsets = append(res.Docsets, ds)
+				}
+			}
+			res.Text = res.Text[colon+1:]
+		}
+	}
+
+	return res
+}
+
+// MatchesDocset checks whether the docset is in the query's scope.
+func (q Query) MatchesDocset(ds IndexedDocset) bool {
+	if len(q.Docsets) == 0 {
+		return true
+	}
+	for _, wanted := range q.Docsets {
+		if ds.Matches(wanted) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesType checks whether symbols of the given normalized type are wanted.
+func (q Query) MatchesType(tp string) bool {
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, wanted := range q.Types {
+		if strings.EqualFold(wanted, tp) {
+			return true
+		}
+	}
+	return false
+}
+
+// docsetKeywords returns the default keywords of a docset: its lowercased
+// names, and their first words, so that both `python_3:` and `python:` scope
+// the search to "Python 3".
+func docsetKeywords(names ...string) []string {
+	var res []string
+	seen := make(map[string]bool)
+	add := func(kw string) {
+		if kw != "" && !seen[kw] {
+			seen[kw] = true
+			res = append(res, kw)
+		}
+	}
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		add(lower)
+		words := strings.FieldsFunc(lower, func(r rune) bool {
+			return r == ' ' || r == '_' || r == '-'
+		})
+		if len(words) > 0 {
+			add(strings.TrimRightFunc(words[0], unicode.IsDigit))
+		}
+	}
+	return res
+}
@@ -0,0 +1,56 @@
+package zealindex
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	// only Node.js is installed
+	isDocset := func(name string) bool {
+		name, _ = SplitDocsetKey(name)
+		return strings.EqualFold(name, "node.js")
+	}
+
+	for _, test := range []struct {
+		query string
+		want  Query
+	}{
+		{"", Query{Limit: DefaultResultLimit}},
+		{"path join", Query{Text: "path join", Limit: DefaultResultLimit}},
+		{"python:os.path", Query{Text: "os.path", Docsets: []string{"python"}, Limit: DefaultResultLimit}},
+		{"Python,django:path", Query{Text: "path", Docsets: []string{"python", "django"}, Limit: DefaultResultLimit}},
+		{"python:", Query{Text: "", Docsets: []string{"python"}, Limit: DefaultResultLimit}},
+		{"django@1.11:path", Query{Text: "path", Docsets: []string{"django@1.11"}, Limit: DefaultResultLimit}},
+		{"node.js:fs", Query{Text: "fs", Docsets: []string{"node.js"}, Limit: DefaultResultLimit}},
+		{"Node.js@18.1:fs", Query{Text: "fs", Docsets: []string{"node.js@18.1"}, Limit: DefaultResultLimit}},
+		{"python,node.js:fs", Query{Text: "fs", Docsets: []string{"python", "node.js"}, Limit: DefaultResultLimit}},
+		// not docsets
+		{"os.path:join", Query{Text: "os.path:join", Limit: DefaultResultLimit}},
+		{"node.js,os.path:fs", Query{Text: "node.js,os.path:fs", Limit: DefaultResultLimit}},
+		{"std::vector", Query{Text: "std::vector", Limit: DefaultResultLimit}},
+		{":path", Query{Text: ":path", Limit: DefaultResultLimit}},
+		{"path join:x", Query{Text: "path join:x", Limit: DefaultResultLimit}},
+		{"type:Method path", Query{Text: "path", Types: []string{MapType("Method")}, Limit: DefaultResultLimit}},
+		{"TYPE:func,cl, path", Query{Text: "path", Types: []string{MapType("func"), MapType("cl")}, Limit: DefaultResultLimit}},
+		{"limit:20 path", Query{Text: "path", Limit: 20}},
+		{"python:path type:Function limit:5", Query{Text: "path", Docsets: []string{"python"}, Types: []string{MapType("Function")}, Limit: 5}},
+		// invalid directives
+		{"limit:0 path", Query{Text: "path", Limit: DefaultResultLimit, Invalid: []string{"limit:0"}}},
+		{"limit:x limit:-1", Query{Limit: DefaultResultLimit, Invalid: []string{"limit:x", "limit:-1"}}},
+		{"type: path", Query{Text: "path", Limit: DefaultResultLimit, Invalid: []string{"type:"}}},
+		{"type:, path", Query{Text: "path", Limit: DefaultResultLimit, Invalid: []string{"type:,"}}},
+	} {
+		if got := ParseQuery(test.query, isDocset); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseQueryWithoutKnownDocsets(t *testing.T) {
+	want := Query{Text: "node.js:fs", Limit: DefaultResultLimit}
+	if got := ParseQuery("node.js:fs", nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseQuery(%q) = %+v, want %+v", "node.js:fs", got, want)
+	}
+}
@@ -0,0 +1,151 @@
+package zealindex
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// Ranking adjusts the scores computed by scoreExact/scoreFuzzy, which stay
+// the base of the ranking.  Weights are added to the score of every result
+// from a matching docset (by id, lowercased name or keyword) or of a matching
+// type (as returned by MapType).
+type Ranking struct {
+	DocsetWeights map[string]int
+	TypeWeights   map[string]int
+	// Added to the score of the most recently opened page, decreasing for
+	// pages opened earlier.  0 disables the boost.
+	RecentBoost int
+}
+
+const rankingKey = "ranking"
+
+// LoadRanking reads the ranking stored in the cache DB, returning an empty
+// one if none was saved yet.
+func LoadRanking() Ranking {
+	var res Ranking
+	q, err := GetCacheDB().Query("SELECT value FROM kv WHERE key = ?", rankingKey)
+	if err != nil {
+		return res
+	}
+	defer q.Close()
+	if q.Next() {
+		var value []byte
+		q.Scan(&value)
+		json.Unmarshal(value, &res)
+	}
+	return res
+}
+
+func SaveRanking(r Ranking) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = GetCacheDB().Exec("INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)", rankingKey, value)
+	return err
+}
+
+const maxRecentlyOpened = 100
+
+// RecentlyOpened tracks the pages most recently opened by the user.
+type RecentlyOpened struct {
+	paths []string // oldest first
+	lock  sync.Mutex
+}
+
+func NewRecentlyOpened() *RecentlyOpened {
+	return &RecentlyOpened{}
+}
+
+// Record marks the page as opened.  Any fragment of the path is ignored.
+func (r *RecentlyOpened) Record(path string) {
+	path = pagePath(path)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, p := range r.paths {
+		if p == path {
+			r.paths = append(r.paths[:i], r.paths[i+1:]...)
+			break
+		}
+	}
+	r.paths = append(r.paths, path)
+	if len(r.paths) > maxRecentlyOpened {
+		r.paths = r.paths[len(r.paths)-maxRecentlyOpened:]
+	}
+}
+
+// boosts maps recently opened pages to their boost, from boost for the most
+// recent one down to 1.
+func (r *RecentlyOpened) boosts(boost int) map[string]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := make(map[string]int)
+	for i, p := range r.paths {
+		res[p] = max(1, boost*(i+1)/len(r.paths))
+	}
+	return res
+}
+
+func pagePath(path string) string {
+	if i := strings.Index(path, "#"); i != -1 {
+		return path[:i]
+	}
+	return path
+}
+
+// ranker applies a Ranking during a single search.
+type ranker struct {
+	ranking Ranking
+	recent  map[string]int
+	docsets map[*IndexSegment]int
+}
+
+func newRanker(ranking Ranking, recent *RecentlyOpened) *ranker {
+	res := &ranker{ranking, nil, make(map[*IndexSegment]int)}
+	if ranking.RecentBoost > 0 && recent != nil {
+		res.recent = recent.boosts(ranking.RecentBoost)
+	}
+	return res
+}
+
+func (r *ranker) docsetWeight(ds IndexedDocset) int {
+	if len(r.ranking.DocsetWeights) == 0 {
+		return 0
+	}
+	if w, ok := r.ranking.DocsetWeights[ds.Id]; ok {
+		return w
+	}
+	if w, ok := r.ranking.DocsetWeights[strings.ToLower(ds.Name)]; ok {
+		return w
+	}
+	for _, kw := range ds.Keywords {
+		if w, ok := r.ranking.DocsetWeights[kw]; ok {
+			return w
+		}
+	}
+	for _, alias := range ds.Aliases {
+		if w, ok := r.ranking.DocsetWeights[alias]; ok {
+			return w
+		}
+	}
+	return 0
+}
+
+// prepare computes docset weights up front, so that they don't need to be
+// looked up for every result.
+func (r *ranker) prepare(segments []*IndexSegment) {
+	for _, seg := range segments {
+		r.docsets[seg] = r.docsetWeight(seg.Docset)
+	}
+}
+
+func (r *ranker) adjust(score int, seg *IndexSegment, e *IndexEntry) int {
+	score += r.docsets[seg] + r.ranking.TypeWeights[e.Type]
+	if r.recent != nil {
+		score += r.recent[pagePath(e.Path)]
+	}
+	return score
+}
@@ -0,0 +1,28 @@
+package zealindex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSaveRankingReplacesSavedRanking(t *testing.T) {
+	testDataDir(t)
+	if got := LoadRanking(); !reflect.DeepEqual(got, Ranking{}) {
+		t.Errorf("got %+v before saving any ranking", got)
+	}
+	first := Ranking{DocsetWeights: map[string]int{"python": 20}, RecentBoost: 30}
+	second := Ranking{TypeWeights: map[string]int{"Method": 5}}
+	for _, r := range []Ranking{first, second} {
+		if err := SaveRanking(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := LoadRanking(); !reflect.DeepEqual(got, second) {
+		t.Errorf("loaded %+v, want %+v", got, second)
+	}
+	var count int
+	GetCacheDB().QueryRow("SELECT COUNT(*) FROM kv WHERE key = ?", rankingKey).Scan(&count)
+	if count != 1 {
+		t.Errorf("%d rankings stored", count)
+	}
+}
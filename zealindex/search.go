@@ -1,10 +1,10 @@
 package zealindex
 
 import (
+	"context"
 	"runtime"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -24,6 +24,14 @@ func max(x, y int) int {
 	}
 }
 
+func min(x, y int) int {
+	if x < y {
+		return x
+	} else {
+		return y
+	}
+}
+
 // Ported from DevDocs (https://github.com/Thibaut/devdocs), see app/searcher.coffee.
 func scoreExact(matchIndex, matchLen int, value string) int {
 	DOT := "."[0]
@@ -91,6 +99,13 @@ func scoreFuzzy(str string, index int, length int) int {
 }
 
 func matchFuzzy(needle string, haystack string) (start, length int) {
+	return matchFuzzyPositions(needle, haystack, nil)
+}
+
+// matchFuzzyPositions is matchFuzzy, also storing the positions in haystack
+// of the needle's characters it matched in positions unless it's nil, which
+// must then have room for len(needle) ints.
+func matchFuzzyPositions(needle string, haystack string, positions []int) (start, length int) {
 	start = -1
 	length = -1
 
@@ -101,6 +116,11 @@ func matchFuzzy(needle string, haystack string) (start, length int) {
 	bestRecursiveScore := -1
 	bestRecursiveStart := -1
 	bestRecursiveLength := -1
+	var recursivePositions, bestRecursivePositions []int
+	if positions != nil {
+		recursivePositions = make([]int, len(needle))
+		bestRecursivePositions = make([]int, len(needle))
+	}
 
 	i := 0
 	j := 0
@@ -116,17 +136,23 @@ func matchFuzzy(needle string, haystack string) (start, length int) {
 					start = j // first matched char
 
 					// try starting the search later in case the first character occurs again later
-					recursiveStart, recursiveLength := matchFuzzy(needle, haystack[j:])
+					recursiveStart, recursiveLength := matchFuzzyPositions(needle, haystack[j:], recursivePositions)
 					if recursiveStart != -1 {
 						recursiveScore := scoreFuzzy(haystack, recursiveStart, recursiveLength)
 						if recursiveScore > bestRecursiveScore {
 							bestRecursiveScore = recursiveScore
 							bestRecursiveStart = recursiveStart
 							bestRecursiveLength = recursiveLength
+							for k, pos := range recursivePositions {
+								bestRecursivePositions[k] = j + pos
+							}
 						}
 					}
 				}
 
+				if positions != nil {
+					positions[i] = j - 1
+				}
 				length = j - start + 1
 				found = true
 				break
@@ -160,6 +186,7 @@ func matchFuzzy(needle string, haystack string) (start, length int) {
 				// (smaller distance from first char to 2nd char)
 				start = bestRecursiveStart
 				length = bestRecursiveLength
+				copy(positions, bestRecursivePositions)
 			} else {
 				start = -1
 				length = -1
@@ -172,6 +199,7 @@ func matchFuzzy(needle string, haystack string) (start, length int) {
 	if bestRecursiveScore > score {
 		start = bestRecursiveStart
 		length = bestRecursiveLength
+		copy(positions, bestRecursivePositions)
 	}
 
 	return start, length
@@ -183,45 +211,74 @@ type DocsetIcons struct {
 }
 
 type Result struct {
-	QueryId    int
-	Score      int
-	Type       string
-	Res        string
-	Path       string
-	RepoName   string
-	DocsetName string
-	DocsetId   string
+	QueryId       int
+	Score         int
+	Type          string
+	Res           string
+	Path          string
+	RepoName      string
+	DocsetName    string
+	DocsetId      string
+	DocsetVersion string
+	Matches       [][2]int // byte ranges of Res matching the query
+	// other places the same symbol was found in, when collapsing results
+	Alternates []Alternate `json:",omitempty"`
 }
 
-type GlobalIndex struct {
-	All         *[]string
-	AllMunged   *[]string
-	Paths       *[]string
-	Docsets     *[]int
-	Types       *[]string
-	DocsetNames *[][]string
-	Lock        sync.RWMutex
+type Alternate struct {
+	Path          string
+	RepoName      string
+	DocsetName    string
+	DocsetId      string
+	DocsetVersion string
 }
 
-func (i *GlobalIndex) UpdateWith(i2 *GlobalIndex) {
-	(*i).Lock.Lock()
-	(*i).All = (*i2).All
-	(*i).AllMunged = (*i2).AllMunged
-	(*i).Paths = (*i2).Paths
-	(*i).Docsets = (*i2).Docsets
-	(*i).Types = (*i2).Types
-	(*i).DocsetNames = (*i2).DocsetNames
-	(*i).Lock.Unlock()
+// collapseResults merges results with the same name and type into one, with
+// the others listed as its alternates.  It consumes all count results from
+// next, as alternates of the best groups can come from anywhere, and returns
+// at most limit groups, and the number of all groups.
+func collapseResults(ctx context.Context, count int, next func() Result, limit int) ([]Result, int) {
+	var groups []Result
+	byKey := make(map[string]int) // -1 for groups beyond the limit
+	for i := 0; i < count; i++ {
+		if i%cancelCheckInterval == 0 && cancelled(ctx) {
+			break
+		}
+		r := next()
+		key := r.Type + "\x00" + r.Res
+		if g, ok := byKey[key]; ok {
+			if g >= 0 {
+				groups[g].Alternates = append(groups[g].Alternates, Alternate{r.Path, r.RepoName, r.DocsetName, r.DocsetId, r.DocsetVersion})
+			}
+		} else if len(groups) < limit {
+			byKey[key] = len(groups)
+			groups = append(groups, r)
+		} else {
+			byKey[key] = -1
+		}
+	}
+	return groups, len(byKey)
 }
 
-type searcher struct {
-	index     *GlobalIndex
-	lastQuery *int
-	curQuery  int
+type SearchStats struct {
+	QueryId int
+	// number of matches, or of groups when collapsing, regardless of the
+	// query's offset and limit
+	Total    int
+	Duration time.Duration
 }
 
-func NewSearcher(index *GlobalIndex, lastQuery *int) searcher {
-	return searcher{index, lastQuery, 0}
+// How many entries are matched between checks whether the search was
+// cancelled.
+const cancelCheckInterval = 1024
+
+func cancelled(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
 }
 
 func CompareRes(a, b Result) bool {
@@ -232,51 +289,75 @@ func CompareRes(a, b Result) bool {
 	}
 }
 
-func SearchAllDocs(self *searcher, inStr string, allowedDocs map[string]bool, resultCb func(Result), timeCb func(int, time.Duration)) {
-	curQuery := *self.lastQuery + 1
-	*self.lastQuery = curQuery
-
+// SearchAllDocs searches index, calling resultCb with the best results in
+// order and timeCb once done.  Neither is called anymore once ctx is cancelled,
+// for example because a newer query replaced this one.
+func SearchAllDocs(ctx context.Context, index *GlobalIndex, queryId int, query Query, allowedDocs map[string]bool, resultCb func(Result), timeCb func(SearchStats)) {
 	startTime := time.Now()
-	qMunged := Munge(inStr)
+	qMunged := Munge(query.Text)
+	qMask := charsetMask(qMunged)
 
 	threads := runtime.NumCPU()
 
 	resChan := make(chan []Result, threads)
 
-	index := *self.index
-	index.Lock.RLock()
+	snapshot := index.Snapshot()
+	total := snapshot.Len()
+	rank := newRanker(index.Ranking(), index.recent)
+	rank.prepare(snapshot.Segments)
 
 	for cpu := 0; cpu < threads; cpu++ {
-		all := *index.All
-		allMunged := *index.AllMunged
-		paths := *index.Paths
-		nums := *index.Docsets
-		types := *index.Types
-		names := *index.DocsetNames
 		go (func(cpu int) {
 			var res []Result
-			i0 := cpu * len(all) / threads
-			i1 := (cpu + 1) * len(allMunged) / threads
-			for i, s := range allMunged[i0:i1] {
-				if *self.lastQuery != curQuery {
+			i0 := cpu * total / threads
+			i1 := (cpu + 1) * total / threads
+			offset := 0
+			for _, seg := range snapshot.Segments {
+				if cancelled(ctx) {
 					break
 				}
-				if allowedDocs != nil && !allowedDocs[names[nums[i0+i]][2]] {
+				start := max(i0-offset, 0)
+				end := min(i1-offset, len(seg.Entries))
+				offset += len(seg.Entries)
+				if start >= end || !seg.Docset.InScope(allowedDocs) || !query.MatchesDocset(seg.Docset) {
 					continue
 				}
-				exactIndex := strings.Index(s, qMunged)
-				if exactIndex != -1 {
-					repo := names[nums[i0+i]][0]
-					name := names[nums[i0+i]][1]
-					dsid := names[nums[i0+i]][2]
-					res = append(res, Result{-1, scoreExact(exactIndex, len(qMunged), s) + 100, types[i0+1], all[i0+i], paths[i0+i], repo, name, dsid})
-				} else {
-					start, length := matchFuzzy(qMunged, s)
-					if start != -1 {
-						repo := names[nums[i0+i]][0]
-						name := names[nums[i0+i]][1]
-						dsid := names[nums[i0+i]][2]
-						res = append(res, Result{-1, scoreFuzzy(s, start, length), types[i0+1], all[i0+i], paths[i0+i], repo, name, dsid})
+				ds := seg.Docset
+				var candidates []int32
+				haveCandidates := false
+				if seg.trigrams != nil {
+					candidates, haveCandidates = seg.trigrams.candidates(qMunged)
+					first := sort.Search(len(candidates), func(i int) bool {
+						return int(candidates[i]) >= start
+					})
+					candidates = candidates[first:]
+				}
+				for i := start; i < end; i++ {
+					if (i-start)%cancelCheckInterval == 0 && cancelled(ctx) {
+						break
+					}
+					isCandidate := !haveCandidates
+					if haveCandidates && len(candidates) > 0 && int(candidates[0]) == i {
+						candidates = candidates[1:]
+						isCandidate = true
+					}
+					e := &seg.Entries[i]
+					if !query.MatchesType(e.Type) {
+						continue
+					}
+					exactIndex := -1
+					if isCandidate {
+						exactIndex = strings.Index(e.Munged, qMunged)
+					}
+					if exactIndex != -1 {
+						score := rank.adjust(scoreExact(exactIndex, len(qMunged), e.Munged)+100, seg, e)
+						res = append(res, Result{-1, score, e.Type, e.Name, e.Path, ds.RepoName, ds.Name, ds.Id, ds.Version, nil, nil})
+					} else if seg.trigrams == nil || seg.trigrams.charsets[i]&qMask == qMask {
+						start, length := matchFuzzy(qMunged, e.Munged)
+						if start != -1 {
+							score := rank.adjust(scoreFuzzy(e.Munged, start, length), seg, e)
+							res = append(res, Result{-1, score, e.Type, e.Name, e.Path, ds.RepoName, ds.Name, ds.Id, ds.Version, nil, nil})
+						}
 					}
 				}
 			}
@@ -295,17 +376,12 @@ func SearchAllDocs(self *searcher, inStr string, allowedDocs map[string]bool, re
 		res[cpu] = <-resChan
 		sum += len(res[cpu])
 	}
-	index.Lock.RUnlock()
 
 	indices := make([]int, threads)
-
-	returned := 0
-	for sum > returned {
-		if *self.lastQuery != curQuery || returned > 100 {
-			break
-		}
+	// returns the best result not returned yet from all threads' results
+	next := func() Result {
 		bestIndex := -1
-		bestRes := Result{-1, -999999, "", "", "", "", "", ""}
+		bestRes := Result{-1, -999999, "", "", "", "", "", "", "", nil, nil}
 		for i := 0; i < threads; i++ {
 			if indices[i] < len(res[i]) {
 				if CompareRes(res[i][indices[i]], bestRes) {
@@ -315,11 +391,40 @@ func SearchAllDocs(self *searcher, inStr string, allowedDocs map[string]bool, re
 			}
 		}
 		indices[bestIndex] += 1
-		bestRes.QueryId = curQuery
-		resultCb(bestRes)
-		returned += 1
+		bestRes.QueryId = queryId
+		return bestRes
+	}
+
+	matches := sum
+	if query.Collapse {
+		var groups []Result
+		groups, matches = collapseResults(ctx, sum, next, query.Offset+query.Limit)
+		for _, r := range groups {
+			if query.Offset > 0 {
+				query.Offset -= 1
+				continue
+			}
+			if cancelled(ctx) {
+				break
+			}
+			r.Matches = highlightRanges(qMunged, r.Res)
+			resultCb(r)
+		}
+	} else {
+		returned := 0
+		for sum > returned {
+			if cancelled(ctx) || returned >= query.Offset+query.Limit {
+				break
+			}
+			bestRes := next()
+			if returned >= query.Offset {
+				bestRes.Matches = highlightRanges(qMunged, bestRes.Res)
+				resultCb(bestRes)
+			}
+			returned += 1
+		}
 	}
-	if *self.lastQuery == curQuery {
-		timeCb(self.curQuery, time.Since(startTime))
+	if !cancelled(ctx) {
+		timeCb(SearchStats{queryId, matches, time.Since(startTime)})
 	}
 }
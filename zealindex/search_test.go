@@ -0,0 +1,210 @@
+package zealindex
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var testWords = []string{
+	"path", "join", "string", "vector", "map", "buffer", "read", "write",
+	"open", "close", "socket", "thread", "lock", "parse", "format", "widget",
+}
+
+var testTypes = []string{"Function", "Method", "Class", "Constant"}
+
+// testIndex builds an index of generated docsets with names like
+// "mod3.Buffer.writeString".
+func testIndex(trigrams bool, docsets, entriesPerDocset int) *GlobalIndex {
+	rnd := rand.New(rand.NewSource(1))
+	word := func() string {
+		return testWords[rnd.Intn(len(testWords))]
+	}
+	idx := NewGlobalIndex()
+	if trigrams {
+		idx.EnableTrigramIndex()
+	}
+	for d := 0; d < docsets; d++ {
+		entries := make([]IndexEntry, entriesPerDocset)
+		for i := range entries {
+			name := "mod" + strconv.Itoa(rnd.Intn(10)) + "." + word() + "." + word() + word()
+			entries[i] = IndexEntry{name, "", "page" + strconv.Itoa(i) + ".html", testTypes[rnd.Intn(len(testTypes))]}
+		}
+		id := strconv.Itoa(d)
+		idx.Add(IndexedDocset{"test", "Docset " + id, id, nil, nil, ""}, entries)
+	}
+	return idx
+}
+
+func searchAll(idx *GlobalIndex, q string) ([]Result, SearchStats) {
+	query := ParseQuery(q, nil)
+	query.Limit = 1 << 30
+	var res []Result
+	var stats SearchStats
+	SearchAllDocs(context.Background(), idx, 1, query, nil, func(r Result) {
+		res = append(res, r)
+	}, func(s SearchStats) {
+		stats = s
+	})
+	return res, stats
+}
+
+func TestTrigramIndexMatchesLinearScan(t *testing.T) {
+	linear := testIndex(false, 5, 2000)
+	trigrams := testIndex(true, 5, 2000)
+	for _, q := range []string{"", "p", "pa", "path", "pathjoin", "buffer.read", "bfrd", "mod3.", "xyz", "type:Method str", "lock lock"} {
+		want, wantStats := searchAll(linear, q)
+		got, gotStats := searchAll(trigrams, q)
+		// results with the same score and name may come in any order
+		for _, res := range [][]Result{want, got} {
+			sort.SliceStable(res, func(i, j int) bool {
+				if res[i].Score != res[j].Score || res[i].Res != res[j].Res {
+					return CompareRes(res[i], res[j])
+				}
+				return res[i].DocsetId+res[i].Path < res[j].DocsetId+res[j].Path
+			})
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: trigram index returned %d results, linear scan %d, or they differ", q, len(got), len(want))
+		}
+		if gotStats.Total != wantStats.Total {
+			t.Errorf("%q: total %d, want %d", q, gotStats.Total, wantStats.Total)
+		}
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	for _, bench := range []struct {
+		name     string
+		trigrams bool
+	}{{"linear", false}, {"trigrams", true}} {
+		idx := testIndex(bench.trigrams, 20, 20000)
+		for _, q := range []string{"join", "bufferread", "mod3.socket"} {
+			query := ParseQuery(q, nil)
+			b.Run(bench.name+"/"+q, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					SearchAllDocs(context.Background(), idx, i, query, nil, func(Result) {}, func(SearchStats) {})
+				}
+			})
+		}
+	}
+}
+
+func TestSearchDuringIndexUpdates(t *testing.T) {
+	idx := testIndex(true, 4, 1000)
+	extra := testIndex(false, 1, 1000).Snapshot().Segments[0].Entries
+	// the entries of every docset, by id
+	entries := map[string]map[IndexEntry]bool{"extra": {}}
+	for _, seg := range idx.Snapshot().Segments {
+		entries[seg.Docset.Id] = make(map[IndexEntry]bool)
+		for _, e := range seg.Entries {
+			entries[seg.Docset.Id][IndexEntry{e.Name, "", e.Path, e.Type}] = true
+		}
+	}
+	for _, e := range extra {
+		entries["extra"][IndexEntry{e.Name, "", e.Path, e.Type}] = true
+	}
+
+	// Every iteration adds a docset with the iteration as its version, and
+	// removes the one added two iterations before.  All versions up to
+	// removedThrough are gone, none after adding are there yet.
+	var adding, removedThrough int64 = -1, -1
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go (func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			id := "extra" + strconv.Itoa(i%3)
+			atomic.StoreInt64(&adding, int64(i))
+			idx.Add(IndexedDocset{"test", "Extra", id, nil, nil, strconv.Itoa(i)}, append([]IndexEntry(nil), extra...))
+			idx.SetAliases("test", id, []string{"x" + strconv.Itoa(i)})
+			idx.SetRanking(Ranking{DocsetWeights: map[string]int{id: i}, RecentBoost: i})
+			idx.RecordOpened("page" + strconv.Itoa(i) + ".html")
+			idx.RemoveDocset("extra" + strconv.Itoa((i+1)%3))
+			atomic.StoreInt64(&removedThrough, int64(i-2))
+		}
+	})()
+
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelAfter := -1
+		if i%2 == 1 {
+			cancelAfter = 10 // cancelled halfway through every other search
+		}
+		removed := atomic.LoadInt64(&removedThrough)
+		var results []Result
+		stats := 0
+		SearchAllDocs(ctx, idx, i, ParseQuery("pathjoin", nil), nil, func(r Result) {
+			if stats > 0 {
+				t.Errorf("search %d: result after the stats", i)
+			}
+			results = append(results, r)
+			if len(results) == cancelAfter {
+				cancel()
+			}
+		}, func(SearchStats) {
+			stats++
+		})
+		added := atomic.LoadInt64(&adding)
+		cancel()
+
+		if cancelAfter == -1 && stats != 1 || cancelAfter != -1 && stats != 0 {
+			t.Errorf("search %d: stats reported %d times", i, stats)
+		}
+		if cancelAfter != -1 && len(results) != cancelAfter {
+			t.Errorf("search %d: %d results, want %d before it was cancelled", i, len(results), cancelAfter)
+		}
+		for _, r := range results {
+			docset := r.DocsetId
+			if strings.HasPrefix(docset, "extra") {
+				docset = "extra"
+				version, _ := strconv.ParseInt(r.DocsetVersion, 10, 64)
+				if version <= removed || version > added {
+					t.Errorf("search %d: result from version %d, which wasn't indexed during the search (versions %d to %d)",
+						i, version, removed+1, added)
+				}
+			}
+			if !entries[docset][IndexEntry{r.Res, "", r.Path, r.Type}] {
+				t.Errorf("search %d: result %v isn't an entry of docset %s", i, r, r.DocsetId)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestCancelledSearchStopsCallbacks(t *testing.T) {
+	idx := testIndex(true, 4, 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := 0
+	SearchAllDocs(ctx, idx, 1, ParseQuery("path", nil), nil, func(Result) {
+		results++
+		if results == 5 {
+			cancel()
+		}
+	}, func(SearchStats) {
+		t.Error("timeCb called after the search was cancelled")
+	})
+	if results != 5 {
+		t.Errorf("got %d results, want 5 before the search was cancelled", results)
+	}
+
+	SearchAllDocs(ctx, idx, 2, ParseQuery("path", nil), nil, func(Result) {
+		t.Error("resultCb called for a cancelled search")
+	}, func(SearchStats) {
+		t.Error("timeCb called for a cancelled search")
+	})
+}
@@ -0,0 +1,110 @@
+package zealindex
+
+import (
+	"sort"
+)
+
+// trigramIndex narrows down the entries of a segment worth running the
+// matchers on.  Exact matches must contain every trigram of the query, and
+// fuzzy matches must contain every character of it, so both filters only
+// skip entries that can't match anyway and the scores stay unchanged.
+type trigramIndex struct {
+	postings map[uint32][]int32 // trigram -> sorted entry indices
+	charsets []uint64           // per-entry bitmask of contained characters
+}
+
+func trigramAt(s string, i int) uint32 {
+	return uint32(s[i])<<16 | uint32(s[i+1])<<8 | uint32(s[i+2])
+}
+
+func charBit(c byte) uint64 {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return 1 << (c - 'a')
+	case c >= '0' && c <= '9':
+		return 1 << (26 + c - '0')
+	case c == '.':
+		return 1 << 36
+	case c == '_':
+		return 1 << 37
+	default:
+		return 1 << (38 + c%26)
+	}
+}
+
+func charsetMask(s string) uint64 {
+	var res uint64
+	for i := 0; i < len(s); i++ {
+		res |= charBit(s[i])
+	}
+	return res
+}
+
+func newTrigramIndex(entries []IndexEntry) *trigramIndex {
+	res := &trigramIndex{
+		make(map[uint32][]int32),
+		make([]uint64, len(entries)),
+	}
+	for i, e := range entries {
+		s := e.Munged
+		res.charsets[i] = charsetMask(s)
+		for j := 0; j+3 <= len(s); j++ {
+			t := trigramAt(s, j)
+			list := res.postings[t]
+			// entries are visited in order, so checking the last one is
+			// enough to skip repeated trigrams
+			if len(list) == 0 || list[len(list)-1] != int32(i) {
+				res.postings[t] = append(list, int32(i))
+			}
+		}
+	}
+	return res
+}
+
+// candidates returns the sorted indices of entries containing all trigrams
+// of the query.  ok is false for queries shorter than a trigram, in which case
+// every entry is a candidate.
+func (t *trigramIndex) candidates(q string) (res []int32, ok bool) {
+	if len(q) < 3 {
+		return nil, false
+	}
+	var lists [][]int32
+	seen := make(map[uint32]bool)
+	for i := 0; i+3 <= len(q); i++ {
+		tri := trigramAt(q, i)
+		if seen[tri] {
+			continue
+		}
+		seen[tri] = true
+		list, exists := t.postings[tri]
+		if !exists {
+			return nil, true
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		return len(lists[i]) < len(lists[j])
+	})
+
+	res = lists[0]
+	for _, list := range lists[1:] {
+		var next []int32
+		j := 0
+		for _, v := range res {
+			for j < len(list) && list[j] < v {
+				j++
+			}
+			if j == len(list) {
+				break
+			}
+			if list[j] == v {
+				next = append(next, v)
+			}
+		}
+		res = next
+		if len(res) == 0 {
+			break
+		}
+	}
+	return res, true
+}
@@ -0,0 +1,221 @@
+package zealindex
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// UpdatableRepo is implemented by repos whose docsets can be updated from a
+// feed.
+type UpdatableRepo interface {
+	FeedRepo
+	// UpdateDocset installs the latest revision of an installed docset in
+	// place of the current one, which is kept until the new one is ready.
+	UpdateDocset(ctx context.Context, idx *GlobalIndex, id string, job *RunningJob) error
+}
+
+// ErrUpToDate is returned when updating a docset with no newer revision.
+var ErrUpToDate = errors.New("already up to date")
+
+// migrateInstalledRevisions records the version and revision of installed
+// docsets, which were only known from the feed before.
+func migrateInstalledRevisions(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"ALTER TABLE installed_docs ADD COLUMN version TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE installed_docs ADD COLUMN revision TEXT NOT NULL DEFAULT ''",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	items, err := installedFeedItems(tx)
+	if err != nil {
+		return err
+	}
+	// feeds were only fetched when the cache was empty, so they still
+	// describe what was installed
+	for id, item := range items {
+		_, err = tx.Exec("UPDATE installed_docs SET version = ?, revision = ? WHERE available_doc_id = ?",
+			firstVersion(item), item.Revision, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installedFeedItems decodes the feed items of installed docsets, by id.
+// Migrations can't use json_extract, as go-sqlite3 isn't always built with
+// JSON1.
+func installedFeedItems(tx *sql.Tx) (map[int64]RepoItem, error) {
+	rows, err := tx.Query("SELECT DISTINCT a.id, a.json FROM installed_docs i " +
+		"INNER JOIN available_docs a ON i.available_doc_id = a.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int64]RepoItem)
+	for rows.Next() {
+		var id int64
+		var rawJson []byte
+		if err = rows.Scan(&id, &rawJson); err != nil {
+			return nil, err
+		}
+		var item RepoItem
+		json.Unmarshal(rawJson, &item)
+		res[id] = item
+	}
+	return res, rows.Err()
+}
+
+func firstVersion(item RepoItem) string {
+	if len(item.Versions) > 0 {
+		return item.Versions[0]
+	}
+	return ""
+}
+
+// isNewer compares revisions and versions component by component, like
+// "1.10" > "1.9".  Other strings can't be ordered, so any change counts as
+// newer, including the feed gaining a revision the installed docset didn't
+// have.
+func isNewer(feed, installed string) bool {
+	if feed == "" {
+		return false
+	} else if installed == "" {
+		return true
+	}
+	f, okF := versionNumbers(feed)
+	i, okI := versionNumbers(installed)
+	if !okF || !okI {
+		return feed != installed
+	}
+	for n := 0; n < len(f) || n < len(i); n++ {
+		var a, b uint64 // missing components count as 0
+		if n < len(f) {
+			a = f[n]
+		}
+		if n < len(i) {
+			b = i[n]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return false
+}
+
+// versionNumbers splits a dotted version like "3.12.1" into its numbers.
+func versionNumbers(version string) ([]uint64, bool) {
+	var res []uint64
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		res = append(res, n)
+	}
+	return res, true
+}
+
+// updateAvailable tells whether the feed item is newer than the installed
+// version and revision.  Feeds without revisions are compared by version.
+func updateAvailable(feed RepoItem, version, revision string) bool {
+	if feed.Revision != "" || revision != "" {
+		return isNewer(feed.Revision, revision)
+	}
+	return isNewer(firstVersion(feed), version)
+}
+
+// UpdateDocset extracts the new revision next to the installed one, and
+// only replaces it once the new one could be indexed.  Searches keep using
+// the old entries until the new ones are published.  Pinned versions aren't
+// updated.
+func (d DashRepo) UpdateDocset(ctx context.Context, idx *GlobalIndex, id string, job *RunningJob) error {
+	installed, err := d.installedDocsets(id)
+	if err != nil {
+		return err
+	} else if len(installed) == 0 || installed[0].pinned {
+		return errors.New("not installed: " + id)
+	}
+	ds := installed[0]
+	item, ok := d.GetAvailableItem(ds.item.Id)
+	if !ok {
+		return errors.New("not in the feed: " + id)
+	}
+	if !updateAvailable(item, ds.version, ds.revision) {
+		return ErrUpToDate
+	}
+	version := firstVersion(item)
+	if pinned, err := d.installedDocsets(DocsetKey(item.Id, version)); err != nil {
+		return err
+	} else if version != "" && version != ds.version && len(pinned) > 0 {
+		return errors.New("version " + version + " is installed already")
+	}
+
+	job.SetState(JobDownloading)
+	archive := filepath.Join(TempDir(), "docset-"+item.Id+".download")
+	defer os.Remove(archive)
+	err = downloadArchive(ctx, archiveURLs(item), archive, item.ArchiveSize, item.ArchiveSha256, job.SetProgress)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	job.SetState(JobExtracting)
+	staged := dataPath(ds.file + ".zealdocset.update")
+	if err = extractDocsTo(ctx, staged, item.Title, f, info.Size(), job.SetProgress); err != nil {
+		return err
+	}
+	defer os.Remove(staged) // unless renamed
+	job.SetState(JobIndexing)
+	entries, counts, err := readDocsetIndex(staged, item.Title+".docset", ds.pathPrefix())
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	// the new revision is recorded before the old file is replaced, and the
+	// record is reverted if replacing it fails, so that the DB never lists a
+	// revision which isn't installed
+	const update = "UPDATE installed_docs SET version = ?, revision = ? WHERE available_doc_id = ? AND version = ?"
+	if _, err = GetCacheDB().Exec(update, version, item.Revision, item.Id, ds.version); err != nil {
+		return err
+	}
+	if err = os.Rename(staged, ds.path()); err != nil {
+		if _, revertErr := GetCacheDB().Exec(update, ds.version, ds.revision, item.Id, version); revertErr != nil {
+			fmt.Println("failed to revert the update of " + item.Title + ": " + revertErr.Error())
+		}
+		return err
+	}
+
+	if err = saveCachedIndex(ds.path(), cachedIndex{Entries: entries, SymbolCounts: counts}); err != nil {
+		fmt.Println("failed to cache index of " + ds.file + ": " + err.Error())
+	}
+	oldVersion := ds.version
+	ds.item, ds.version, ds.revision = item, version, item.Revision
+	d.addToIndex(idx, ds, oldVersion, entries, counts)
+	if _, err = os.Stat(fullTextPath(ds.file)); err == nil {
+		if err = buildFullTextIndex(ds.path(), fullTextPath(ds.file)); err != nil {
+			fmt.Println("failed to rebuild full-text index: " + err.Error())
+		}
+	}
+	return nil
+}
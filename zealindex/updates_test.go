@@ -0,0 +1,55 @@
+package zealindex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVersionNumbers(t *testing.T) {
+	for _, test := range []struct {
+		version string
+		want    []uint64
+		ok      bool
+	}{
+		{"3", []uint64{3}, true},
+		{"1.10", []uint64{1, 10}, true},
+		{"3.12.1", []uint64{3, 12, 1}, true},
+		{"1.9-beta", nil, false},
+		{"1..2", nil, false},
+		{"", nil, false},
+		{"v2", nil, false},
+	} {
+		got, ok := versionNumbers(test.version)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("versionNumbers(%q) = %v, %v, want %v, %v", test.version, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestIsNewer(t *testing.T) {
+	for _, test := range []struct {
+		feed, installed string
+		want            bool
+	}{
+		{"1.10", "1.9", true},
+		{"1.9", "1.10", false},
+		{"2", "10", false},
+		{"10", "9", true},
+		{"1.2.1", "1.2", true},
+		{"1.2", "1.2.1", false},
+		{"1.2.0", "1.2", false},
+		{"1.2", "1.2.0", false},
+		{"1.2", "1.2", false},
+		{"", "1.2", false},
+		{"1.2", "", true},
+		{"", "", false},
+		// not numeric, so only a change can be detected
+		{"2024-05", "2024-04", true},
+		{"1.0-beta", "1.0-beta", false},
+		{"1.0", "1.0-beta", true},
+	} {
+		if got := isNewer(test.feed, test.installed); got != test.want {
+			t.Errorf("isNewer(%q, %q) = %v, want %v", test.feed, test.installed, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package zealindex
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strconv"
+)
+
+// installedDocset is an installed version of a docset of a DashRepo.
+type installedDocset struct {
+	item     RepoItem // as in the feed
+	version  string
+	revision string
+	file     string // name of the .zealdocset file, without the extension
+	pinned   bool
+}
+
+func (ds installedDocset) key() string {
+	return DocsetKey(ds.item.Id, ds.version)
+}
+
+func (ds installedDocset) path() string {
+	return docsetPath(ds.file)
+}
+
+// pathPrefix is what paths of the docset's pages start with.  Files inside
+// the .zealdocset are stored under the title, which isn't unique when
+// several versions are installed.
+func (ds installedDocset) pathPrefix() string {
+	return ds.file + ".docset"
+}
+
+// migrateInstalledFiles allows installing several versions of a docset,
+// each in a file of its own.
+func migrateInstalledFiles(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"ALTER TABLE installed_docs ADD COLUMN file TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE installed_docs ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	items, err := installedFeedItems(tx)
+	if err != nil {
+		return err
+	}
+	// docsets used to be stored as <title>.zealdocset
+	for id, item := range items {
+		if _, err = tx.Exec("UPDATE installed_docs SET file = ? WHERE available_doc_id = ?", item.Title, id); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range []string{
+		// reinstalling added duplicate rows
+		"DELETE FROM installed_docs WHERE rowid NOT IN " +
+			"(SELECT MIN(rowid) FROM installed_docs GROUP BY available_doc_id, version)",
+		"CREATE UNIQUE INDEX installed_docs_version ON installed_docs (available_doc_id, version)",
+	} {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLatest checks whether the item is to be installed at the latest version.
+func isLatest(item RepoItem) bool {
+	return item.Version == "" || item.Version == firstVersion(item)
+}
+
+// HasVersion checks whether the feed lists the given version of the item.
+func (item RepoItem) HasVersion(version string) bool {
+	for _, v := range item.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// installedDocsets returns the installed docsets with the given key, or all
+// if it's empty.  Unpinned ones, which follow the feed, come first.
+func (d DashRepo) installedDocsets(key string) ([]installedDocset, error) {
+	id, version := SplitDocsetKey(key)
+	rows, err := GetCacheDB().Query(
+		"SELECT a.id, a.json, i.version, i.revision, i.file, i.pinned FROM installed_docs i "+
+			"INNER JOIN available_docs a ON i.available_doc_id = a.id "+
+			"WHERE a.repo_id = ? AND (? = '' OR a.id = ?) AND (? = '' OR i.version = ?) "+
+			"ORDER BY a.id, i.pinned, i.version",
+		d.repoId, id, id, version, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []installedDocset
+	for rows.Next() {
+		var ds installedDocset
+		var rawJson []byte
+		if err = rows.Scan(&ds.item.Id, &rawJson, &ds.version, &ds.revision, &ds.file, &ds.pinned); err != nil {
+			return nil, err
+		}
+		id := ds.item.Id
+		json.Unmarshal(rawJson, &ds.item)
+		ds.item.Id = id
+		res = append(res, ds)
+	}
+	return res, rows.Err()
+}
+
+// fileFor names the file to install the version of the item in: the one it
+// is installed in already, otherwise the title if it's free and the version
+// isn't pinned, or the title followed by the version.
+func (d DashRepo) fileFor(item RepoItem, version string) (string, error) {
+	var file string
+	err := GetCacheDB().QueryRow(
+		"SELECT file FROM installed_docs WHERE available_doc_id = ? AND version = ?",
+		item.Id, version).Scan(&file)
+	if err == nil {
+		return file, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	base := item.Title
+	if version != "" {
+		base += "@" + version
+	}
+	var candidates []string
+	if !item.Pinned {
+		candidates = append(candidates, item.Title)
+	}
+	candidates = append(candidates, base)
+	for n := 2; ; n++ {
+		for _, name := range candidates {
+			var count int
+			err = GetCacheDB().QueryRow("SELECT COUNT(*) FROM installed_docs WHERE file = ?", name).Scan(&count)
+			if err != nil {
+				return "", err
+			}
+			if _, statErr := os.Stat(docsetPath(name)); count == 0 && os.IsNotExist(statErr) {
+				return name, nil
+			}
+		}
+		candidates = []string{base + "-" + strconv.Itoa(n)}
+	}
+}
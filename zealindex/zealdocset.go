@@ -2,17 +2,18 @@ package zealindex
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"math/rand"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
@@ -191,89 +192,146 @@ func (r ReaderWithProgress) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
-func ExtractDocs(repoId string, title string, f io.Reader, contentType string, size int64, downloadProgressHandlers ProgressHandlers) {
+// gzipMagic starts gzip streams, see RFC 1952.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ExtractDocs stores the files of a gzipped or plain tar archive of the given
+// size in <title>.zealdocset, compressing them on all CPUs.  Nothing is left
+// behind if the archive can't be read completely or ctx is cancelled.
+func ExtractDocs(ctx context.Context, title string, f io.Reader, size int64, progress func(received, total int64)) error {
+	return extractDocsTo(ctx, docsetPath(title), title, f, size, progress)
+}
+
+func extractDocsTo(ctx context.Context, dest, title string, f io.Reader, size int64, progress func(received, total int64)) error {
 	var tr *tar.Reader
 	progressReader := NewReaderWithProgress(f)
-	gz, err := gzip.NewReader(progressReader)
-	if err != nil {
-		// try uncompressed?
-		tr = tar.NewReader(progressReader)
-	} else {
-		check(err)
+	// peek instead of trying gzip.NewReader, which would consume the first
+	// bytes of uncompressed archives
+	br := bufio.NewReader(progressReader)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
 		tr = tar.NewReader(gz)
+	} else {
+		tr = tar.NewReader(br)
 	}
 
-	db, err := sql.Open("sqlite3", title+".zealdocset")
-	check(err)
-
-	db.Exec("DROP TABLE files")
-	db.Exec("CREATE TABLE files(path, blob)")
+	part := partPath(dest)
+	os.Remove(part)
+	db, err := sql.Open("sqlite3", part)
+	if err != nil {
+		return err
+	}
+	if _, err = db.Exec("CREATE TABLE files(path, blob)"); err != nil {
+		db.Close()
+		os.Remove(part)
+		return err
+	}
 
 	threads := runtime.NumCPU()
 	toGzChan := make(chan gzJob, threads)
 	toWriteChan := make(chan gzRes, threads)
 
-	var wg sync.WaitGroup
+	// the first error stops reading the archive, the files already read are
+	// still drained through the pipeline
+	var pipelineErr error
+	var failOnce sync.Once
+	failed := make(chan struct{})
+	fail := func(err error) {
+		failOnce.Do(func() {
+			pipelineErr = err
+			close(failed)
+		})
+	}
 
+	var gzWg sync.WaitGroup
 	for i := 0; i < threads; i += 1 {
+		gzWg.Add(1)
 		go (func() {
-			for {
-				toGz := <-toGzChan
+			defer gzWg.Done()
+			for toGz := range toGzChan {
 				var gzBlob bytes.Buffer
 				zw := gzip.NewWriter(&gzBlob)
-				_, err = zw.Write(toGz.toGz)
-				check(err)
-				check(zw.Close())
-				wg.Add(1)
+				_, err := zw.Write(toGz.toGz)
+				if err == nil {
+					err = zw.Close()
+				}
+				if err != nil {
+					fail(err)
+					continue
+				}
 				toWriteChan <- gzRes{toGz.Hdr, gzBlob.Bytes()}
-				wg.Done()
 			}
 		})()
 	}
+	go (func() {
+		gzWg.Wait()
+		close(toWriteChan)
+	})()
 
+	written := make(chan struct{})
 	go (func() {
-		for {
-			toWrite := <-toWriteChan
+		defer close(written)
+		for toWrite := range toWriteChan {
 			// Fixup name for docsets where title != root dir name (like "Lua 5.1" has a "Lua" root dir)
-			name := strings.SplitAfterN(toWrite.Hdr.Name, "/", 2)[1]
-			name = title + ".docset/" + name
-			_, err = db.Exec(
+			parts := strings.SplitAfterN(toWrite.Hdr.Name, "/", 2)
+			if len(parts) < 2 {
+				continue // outside of the root dir
+			}
+			name := title + ".docset/" + parts[1]
+			_, err := db.Exec(
 				"INSERT INTO files(path, blob) values(?, ?)", name, toWrite.gz)
-			check(err)
-			wg.Done()
+			if err != nil {
+				fail(err)
+			}
 		}
 	})()
 
+read:
 	for {
+		if err := ctx.Err(); err != nil {
+			fail(err)
+			break
+		}
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
+		} else if err != nil {
+			fail(err)
+			break
 		}
-		check(err)
 
 		if hdr.Typeflag != tar.TypeReg {
 			continue
 		}
 
 		var buf = make([]byte, hdr.Size)
-		_, err = io.ReadFull(tr, buf)
-		check(err)
-		wg.Add(1)
-		toGzChan <- gzJob{hdr, buf}
-
-		downloadProgressHandlers.Lock.RLock()
-		for _, v := range downloadProgressHandlers.Map {
-			progress := *progressReader.readIndex
-			if progress >= size {
-				progress = size - 1 // don't send 100% until the db is closed
-			}
-			v(repoId, title, progress, size)
+		if _, err = io.ReadFull(tr, buf); err != nil {
+			fail(err)
+			break
+		}
+		select {
+		case toGzChan <- gzJob{hdr, buf}:
+		case <-failed:
+			break read
 		}
-		downloadProgressHandlers.Lock.RUnlock()
+
+		progress(*progressReader.readIndex, size)
 	}
 
-	wg.Wait()
-	db.Close()
+	close(toGzChan)
+	<-written
+	err = db.Close()
+	if pipelineErr != nil {
+		err = pipelineErr
+	}
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Rename(part, dest)
 }
 
 func ExtractFile(dbName string, path string, w io.Writer) error {
@@ -311,144 +369,171 @@ func ExtractFile(dbName string, path string, w io.Writer) error {
 	}
 }
 
-func chooseRandomMirror(path string) string {
-	cities := []string{"sanfrancisco", "newyork", "london", "frankfurt"};
-	city := cities[rand.Int() % len(cities)]
-	return fmt.Sprintf("https://%s.kapeli.com/%s", city, path);
-}
-
-func (d DashRepo) StartDocsetInstallById(id string, downloadProgressHandlers ProgressHandlers, completed func()) string {
+func (d DashRepo) GetAvailableItem(id string) (RepoItem, bool) {
+	d.itemsLock.RLock()
+	defer d.itemsLock.RUnlock()
 	item, ok := (*d.kapeliItems)[id]
-	if !ok {
-		return ""
+	return item, ok
+}
+
+// InstallDocset downloads the item's archive completely before extracting
+// it, so that dropped connections can be resumed.  The item's Version is
+// pinned if set.
+func (d DashRepo) InstallDocset(ctx context.Context, item RepoItem, job *RunningJob) error {
+	job.SetState(JobDownloading)
+	archive := filepath.Join(TempDir(), "docset-"+DocsetKey(item.Id, item.Version)+".download")
+	defer os.Remove(archive)
+	// the feed only describes the archive of the latest version
+	size, checksum := item.ArchiveSize, item.ArchiveSha256
+	if !isLatest(item) {
+		size, checksum = 0, ""
+	}
+	err := downloadArchive(ctx, archiveURLs(item), archive, size, checksum, job.SetProgress)
+	if err != nil {
+		return err
 	}
-	var resp *http.Response
-	var err error
-	if item.SourceId == "com.kapeli.contrib" {
-		resp, err = http.Get(chooseRandomMirror("feeds/zzz/user_contributed/build/" + item.ContribRepoKey + "/" + item.Archive))
-	} else {
-		resp, err = http.Get("https://go.zealdocs.org/d/com.kapeli/" + item.Name + "/latest")
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
 	}
-	if err == nil {
-		go (func() {
-			ExtractDocs(item.SourceId, (*d.kapeliItems)[item.Id].Title, resp.Body, resp.Header["Content-Type"][0], resp.ContentLength, downloadProgressHandlers)
-			_, err = GetCacheDB().Exec("INSERT INTO installed_docs(available_doc_id) VALUES (?)", id)
-			check(err)
-			completed()
-			downloadProgressHandlers.Lock.RLock()
-			// report 100% only after new index is created:
-			for _, v := range downloadProgressHandlers.Map {
-				v(item.SourceId, (*d.kapeliItems)[item.Id].Title, resp.ContentLength, resp.ContentLength)
-			}
-			downloadProgressHandlers.Lock.RUnlock()
-		})()
-		return item.Name
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
 	}
-	return ""
+	return d.install(ctx, item, f, info.Size(), job)
+}
+
+func (d DashRepo) InstallDocsetFromIo(ctx context.Context, iostream io.Reader, repoItem RepoItem, len int64, job *RunningJob) error {
+	d.itemsLock.Lock()
+	(*d.kapeliItems)[repoItem.Id] = repoItem
+	d.itemsLock.Unlock()
+	return d.install(ctx, repoItem, iostream, len, job)
 }
 
+// install extracts the docset and marks it as installed.  Installing a
+// version again replaces it.
+func (d DashRepo) install(ctx context.Context, item RepoItem, r io.Reader, size int64, job *RunningJob) error {
+	version := item.Version
+	if version == "" {
+		version = firstVersion(item)
+	}
+	file, err := d.fileFor(item, version)
+	if err != nil {
+		return err
+	}
+	_, statErr := os.Stat(docsetPath(file))
+	replacing := statErr == nil
 
-func (d DashRepo) StartDocsetInstallByIo(iostream io.ReadCloser, repoItem RepoItem, len int64, downloadProgressHandlers ProgressHandlers, completed func()) string {
-	go (func() {
-		(*d.kapeliItems)[repoItem.Id] = repoItem
-		ExtractDocs("com.kapeli.local", repoItem.Title, iostream, "", len, downloadProgressHandlers)
-		_, err := GetCacheDB().Exec("INSERT INTO installed_docs(available_doc_id) VALUES (?)", repoItem.Id)
-		check(err)
-		completed()
-		downloadProgressHandlers.Lock.RLock()
-		// report 100% only after new index is created:
-		for _, v := range downloadProgressHandlers.Map {
-			v("com.kapeli.local", (*d.kapeliItems)[repoItem.Id].Title, len, len)
-		}
-		downloadProgressHandlers.Lock.RUnlock()
-	})()
-	return repoItem.Title
+	job.SetState(JobExtracting)
+	if err = extractDocsTo(ctx, docsetPath(file), item.Title, r, size, job.SetProgress); err != nil {
+		return err
+	}
+	_, err = GetCacheDB().Exec(
+		"INSERT OR REPLACE INTO installed_docs(available_doc_id, version, revision, file, pinned) VALUES (?, ?, ?, ?, ?)",
+		item.Id, version, item.Revision, file, item.Pinned)
+	if err != nil {
+		if !replacing {
+			os.Remove(docsetPath(file))
+		}
+		return err
+	}
+	if FullTextOnInstall {
+		job.SetState(JobIndexing)
+		if err := d.BuildFullTextIndex(DocsetKey(item.Id, version)); err != nil {
+			fmt.Println("failed to build full-text index: " + err.Error())
+		}
+	}
+	return nil
 }
 
-func getRepo(repoId int) []RepoItem {
-	dbRes, _ := GetCacheDB().Query("SELECT id, json FROM available_docs WHERE repo_id = ?", repoId)
+func getRepo(repoId int) ([]RepoItem, error) {
+	dbRes, err := GetCacheDB().Query("SELECT id, json FROM available_docs WHERE repo_id = ?", repoId)
+	if err != nil {
+		return nil, err
+	}
+	defer dbRes.Close()
 	var items []RepoItem
 	var item RepoItem
 	for dbRes.Next() {
 		var id string
 		var value []byte
-		dbRes.Scan(&id, &value)
+		if err = dbRes.Scan(&id, &value); err != nil {
+			return nil, err
+		}
 		json.Unmarshal(value, &item)
 		item.Id = id
 		items = append(items, item)
 	}
-	dbRes.Close()
-	return items
+	return items, dbRes.Err()
 }
 
-func (d DashRepo) GetInstalled() []RepoItem {
+// GetInstalled lists every installed version of a docset separately.
+func (d DashRepo) GetInstalled() ([]RepoItem, error) {
+	installed, err := d.installedDocsets("")
+	if err != nil {
+		return nil, err
+	}
 	var items []RepoItem
-	var item RepoItem
-	var id string
-	rows, err := GetCacheDB().Query(
-		"SELECT id, json FROM installed_docs i " +
-		"INNER JOIN available_docs a " +
-		"ON i.available_doc_id = a.id " +
-		"WHERE a.repo_id = ?", d.repoId)
-	check(err)
-	var rawJson []byte
-	for rows.Next() {
-		err = rows.Scan(&id, &rawJson)
-		json.Unmarshal(rawJson, &item)
-		item.Id = id
-		item.SymbolCounts = (*d.symbolCounts)[item.Title]
+	d.itemsLock.RLock()
+	defer d.itemsLock.RUnlock()
+	for _, ds := range installed {
+		item := ds.item
+		item.SymbolCounts = (*d.symbolCounts)[ds.file]
+		// the JSON describes the latest revision in the feed
+		item.UpdateAvailable = !ds.pinned && updateAvailable(item, ds.version, ds.revision)
+		item.Revision = ds.revision
+		item.Version = ds.version
+		item.Pinned = ds.pinned
 		items = append(items, item)
 	}
-	rows.Close()
-	return items
+	return items, nil
 }
 
-func (d DashRepo) GetSymbols(index GlobalIndex, id, tp string) [][]string {
-	q, err := cache.Query("SELECT json FROM available_docs WHERE id=?", id)
-	if err == nil && q.Next() {
-		var jsonDoc []byte
-		q.Scan(&jsonDoc)
-		var doc RepoItem
-		json.Unmarshal(jsonDoc, &doc)
-		id = doc.Title
-	} else {
+// GetSymbols lists the symbols of the unpinned version if the id has none.
+func (d DashRepo) GetSymbols(index *GlobalIndex, id, tp string) [][]string {
+	installed, err := d.installedDocsets(id)
+	if err != nil || len(installed) == 0 {
 		return make([][]string, 0)
 	}
-	q.Close()
 	var res [][]string
-	for i, s := range *index.Types {
-		name := (*index.DocsetNames)[(*index.Docsets)[i]]
-		if name[0] != d.Name() {
+	for _, seg := range index.Snapshot().Segments {
+		if seg.Docset.RepoName != d.Name() || !seg.Docset.hasKey(installed[0].key()) {
 			continue
 		}
-
-		if s == tp && (name[1] == id) {
-			res = append(res, []string{(*index.All)[i], "docs/" + (*index.Paths)[i]})
+		for _, entry := range seg.Entries {
+			if entry.Type == tp {
+				res = append(res, []string{entry.Name, "docs/" + entry.Path})
+			}
 		}
 	}
 	return res
 }
 
-func (d DashRepo) GetChapters(id, path string) [][]string {
-	return make([][]string, 0)
+func (d DashRepo) GetChapters(id, path string) ([][]string, error) {
+	return make([][]string, 0), nil
 }
 
 func (d DashRepo) GetPage(path string, w io.Writer) error {
-	for i, name := range *d.docsetNames {
-		prefix := "/" + name + ".docset/"
+	d.itemsLock.RLock()
+	files := *d.files
+	d.itemsLock.RUnlock()
+	for _, f := range files {
+		prefix := "/" + f.name + ".docset/"
 		if strings.HasPrefix(path, prefix) {
-			return ExtractFile((*d.docsetDbs)[i], path[1:], w)
+			return ExtractFile(docsetPath(f.name), f.title+".docset/"+path[len(prefix):], w)
 		}
 	}
 	return errors.New("not found")
 }
 
-func (d DashRepo) updateRepo(updateDbFrom *[]RepoItem) {
+func (d DashRepo) updateRepo(updateDbFrom *[]RepoItem) error {
 	cacheDb := GetCacheDB()
 	if updateDbFrom != nil {
-		cacheDb.Exec("CREATE TABLE IF NOT EXISTS available_docs (id integer primary key autoincrement, repo_id, name, json)")
-		tx, error := cacheDb.Begin()
-		check(error)
+		tx, err := cacheDb.Begin()
+		if err != nil {
+			return err
+		}
 		for i, item := range *updateDbFrom {
 			itemJson, _ := json.Marshal(item)
 			dbRes, err := tx.Query("SELECT id FROM available_docs WHERE name = ?", item.Name)
@@ -458,64 +543,91 @@ func (d DashRepo) updateRepo(updateDbFrom *[]RepoItem) {
 				tx.Exec("UPDATE available_docs SET json = ? WHERE id = ?", itemJson, id)
 			} else {
 				tx.Exec("INSERT INTO available_docs (repo_id, name, json) VALUES (?, ?, ?)", d.repoId, item.Name, itemJson)
-				dbRes.Close()
-				dbRes, err := tx.Query("SELECT id FROM available_docs WHERE name = ?", item.Name)
+				if dbRes != nil {
+					dbRes.Close()
+				}
+				dbRes, err = tx.Query("SELECT id FROM available_docs WHERE name = ?", item.Name)
 				if err == nil && dbRes.Next() {
 					dbRes.Scan(&id)
 				}
 			}
 			(*updateDbFrom)[i].Id = id
-			dbRes.Close()
+			if dbRes != nil {
+				dbRes.Close()
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return err
 		}
-		tx.Commit()
 	}
-	items := getRepo(d.repoId)
+	items, err := getRepo(d.repoId)
+	if err != nil {
+		return err
+	}
+	d.itemsLock.Lock()
+	defer d.itemsLock.Unlock()
 	for _, item := range items {
 		(*d.kapeliItems)[item.Id] = item
 	}
+	return nil
+}
+
+// docsetFile is an indexed .zealdocset file, whose pages are stored under
+// the docset's title.
+type docsetFile struct {
+	name  string
+	title string
 }
 
 type DashRepo struct {
-	kapeliItems  *map[string]RepoItem
-	docsetNames  *[]string
-	docsetDbs    *[]string
+	kapeliItems *map[string]RepoItem
+	// guards kapeliItems, files and symbolCounts, which change while serving
+	itemsLock    *sync.RWMutex
+	files        *[]docsetFile
 	docsetIcons  *map[string]DocsetIcons
-	symbolCounts *map[string]map[string]int
-	repoId       int // 1 - Dash, 2 - user contrib, 3 - local
+	symbolCounts *map[string]map[string]int // by file name
+	repoId       int                        // 1 - Dash, 2 - user contrib, 3 - local
 }
 
-func _NewDashRepo(repoId int) DashRepo {
+func _NewDashRepo(repoId int) (DashRepo, error) {
 	items := make(map[string]RepoItem)
-	var names []string
-	var dbs []string
+	var files []docsetFile
 	icons := make(map[string]DocsetIcons)
 	counts := make(map[string]map[string]int)
-	res := DashRepo{&items, &names, &dbs, &icons, &counts, repoId}
-	res.GetAvailableForInstall()
-	res.updateRepo(nil)
+	res := DashRepo{&items, &sync.RWMutex{}, &files, &icons, &counts, repoId}
+	// installed docsets work without the feed, which may take long to fetch
+	// or fail while offline
+	res.refreshInBackground()
+	if err := res.updateRepo(nil); err != nil {
+		return res, err
+	}
 
-	rows, _ := GetCacheDB().Query("SELECT json FROM installed_docs i INNER JOIN available_docs a ON i.available_doc_id = a.id")
+	rows, err := GetCacheDB().Query("SELECT json FROM installed_docs i INNER JOIN available_docs a ON i.available_doc_id = a.id")
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
 	for rows.Next() {
 		var data []byte
 		var item RepoItem
-		rows.Scan(&data)
+		if err = rows.Scan(&data); err != nil {
+			return res, err
+		}
 		json.Unmarshal(data, &item)
 		(*res.docsetIcons)[item.Name] = DocsetIcons{item.Icon, item.Icon2x}
 	}
-	rows.Close()
-
-	return res
+	return res, rows.Err()
 }
 
-func NewDashRepo() DashRepo {
+func NewDashRepo() (DashRepo, error) {
 	return _NewDashRepo(1)
 }
 
-func NewDashContribRepo() DashRepo {
+func NewDashContribRepo() (DashRepo, error) {
 	return _NewDashRepo(2)
 }
 
-func NewDashLocalRepo() DashRepo {
+func NewDashLocalRepo() (DashRepo, error) {
 	return _NewDashRepo(3)
 }
 
@@ -529,177 +641,227 @@ func (d DashRepo) Name() string {
 	}
 }
 
-func (d DashRepo) getAvailableForInstallDash() ([]RepoItem, error) {
-	res, err := http.Get("http://api.zealdocs.org/v1/docsets")
-	if err == nil {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return nil, err
-		} else {
-			var items []RepoItem
-			json.Unmarshal(body, &items)
-			d.updateRepo(&items)
-			return items, nil
-		}
-	} else {
+func (d DashRepo) parseDashFeed(url string, body []byte) ([]RepoItem, error) {
+	var items []RepoItem
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, errors.New("invalid docset list at " + url + ": " + err.Error())
+	}
+	if err := d.updateRepo(&items); err != nil {
 		return nil, err
 	}
+	return items, nil
 }
 
 type ContribItem struct {
-	Name    string
-	Icon    string
-	Icon2x  string `json:"icon@2x"`
-	Archive string
-}
-
-func (d DashRepo) getAvailableForInstallContrib() ([]RepoItem, error) {
-	res, err := http.Get(chooseRandomMirror("feeds/zzz/user_contributed/build/index.json"))
-	if err == nil {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return nil, err
-		} else {
-			var items map[string]map[string]ContribItem
-			json.Unmarshal(body, &items)
-			var repoItems []RepoItem
-			for key, item := range items["docsets"] {
-				repoItems = append(repoItems, RepoItem{
-					"com.kapeli.contrib",
-					item.Name,
-					item.Name,
-					make([]string, 0),
-					"",
-					item.Icon,
-					item.Icon2x,
-					"",
-					RepoItemExtra{""},
-					"",
-					item.Archive,
-					key,
-					make(map[string]int),
-				})
+	Name             string
+	Version          string
+	Icon             string
+	Icon2x           string `json:"icon@2x"`
+	Archive          string
+	SpecificVersions []ContribVersion `json:"specific_versions"`
+	// optional, the Kapeli mirrors don't list them
+	ArchiveSize   int64  `json:"archive_size"`
+	ArchiveSha256 string `json:"archive_sha256"`
+}
+
+// ContribVersion is an older version of a contributed docset.
+type ContribVersion struct {
+	Version string
+	Archive string // relative to the docset's directory
+}
+
+func (d DashRepo) parseContribFeed(url string, body []byte) ([]RepoItem, error) {
+	var items map[string]map[string]ContribItem
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, errors.New("invalid docset list at " + url + ": " + err.Error())
+	}
+	var repoItems []RepoItem
+	for key, item := range items["docsets"] {
+		versions := make([]string, 0)
+		if item.Version != "" {
+			versions = append(versions, item.Version)
+		}
+		archives := make(map[string]string)
+		for _, v := range item.SpecificVersions {
+			if _, ok := archives[v.Version]; !ok && v.Version != "" && v.Version != item.Version {
+				versions = append(versions, v.Version)
+				archives[v.Version] = v.Archive
 			}
-			d.updateRepo(&repoItems)
-			return repoItems, nil
 		}
-	} else {
+		repoItems = append(repoItems, RepoItem{
+			SourceId:        "com.kapeli.contrib",
+			Name:            item.Name,
+			Title:           item.Name,
+			Versions:        versions,
+			Icon:            item.Icon,
+			Icon2x:          item.Icon2x,
+			Archive:         item.Archive,
+			ArchiveSize:     item.ArchiveSize,
+			ArchiveSha256:   item.ArchiveSha256,
+			ContribRepoKey:  key,
+			SymbolCounts:    make(map[string]int),
+			VersionArchives: archives,
+		})
+	}
+	if err := d.updateRepo(&repoItems); err != nil {
 		return nil, err
 	}
+	return repoItems, nil
 }
 
-func (d DashRepo) GetAvailableForInstall() ([]RepoItem, error) {
-	repo := getRepo(d.repoId)
-	if len(repo) > 0 {
-		return repo, nil
+// ImportAll indexes all installed versions of the repo's docsets.
+func (d DashRepo) ImportAll(idx *GlobalIndex) error {
+	installed, err := d.installedDocsets("")
+	if err != nil {
+		return err
 	}
-	if d.repoId == 1 {
-		return d.getAvailableForInstallDash()
-	} else {
-		return d.getAvailableForInstallContrib()
+	skipped := make(ImportError)
+	for _, ds := range installed {
+		if err = d.indexInstalled(idx, ds); err != nil {
+			skipped[ds.file+".zealdocset"] = err
+		}
+	}
+	if len(skipped) > 0 {
+		return skipped
 	}
+	return nil
 }
 
-func (d DashRepo) ImportAll(idx GlobalIndex) {
-	files, err := ioutil.ReadDir(".")
-	check(err)
-
-	for _, f := range files {
-		name := f.Name()
-		if !strings.HasSuffix(name, ".zealdocset") {
-			continue
+// IndexDocById indexes the installed version of the docset with the given
+// key, or all installed versions of it.
+func (d DashRepo) IndexDocById(idx *GlobalIndex, id string) error {
+	installed, err := d.installedDocsets(id)
+	if err != nil {
+		return err
+	} else if len(installed) == 0 {
+		return errors.New("not installed: " + id)
+	}
+	for _, ds := range installed {
+		if err = d.indexInstalled(idx, ds); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		res, err := GetCacheDB().Query(
-			"SELECT id, repo_id from available_docs WHERE name=? " +
-				"AND id in (SELECT available_doc_id FROM installed_docs)",
-			strings.Replace(name, ".zealdocset", "", -1),
-		)
-
-		var repoId int
-		var id string
-		check(err)
-		if res.Next() {
-			res.Scan(&id, &repoId)
-			res.Close()
-		} else {
-			res.Close()
-			continue
+func (d DashRepo) indexInstalled(idx *GlobalIndex, ds installedDocset) error {
+	var entries []IndexEntry
+	var counts map[string]int
+	if cached, err := loadCachedIndex(ds.path()); err == nil {
+		entries, counts = cached.Entries, cached.SymbolCounts
+	} else {
+		entries, counts, err = readDocsetIndex(ds.path(), ds.item.Title+".docset", ds.pathPrefix())
+		if err != nil {
+			return err
 		}
-		if repoId != d.repoId {
-			continue
+		err = saveCachedIndex(ds.path(), cachedIndex{Entries: entries, SymbolCounts: counts})
+		if err != nil {
+			fmt.Println("failed to cache index of " + ds.file + ": " + err.Error())
 		}
+	}
+
+	d.addToIndex(idx, ds, ds.version, entries, counts)
+	return nil
+}
 
-		d.IndexDocById(idx, id)
-		check(err)
+// addToIndex publishes the entries of the installed docset, replacing the
+// ones of its oldVersion.
+func (d DashRepo) addToIndex(idx *GlobalIndex, ds installedDocset, oldVersion string, entries []IndexEntry, counts map[string]int) {
+	d.itemsLock.Lock()
+	(*d.symbolCounts)[ds.file] = counts
+	known := false
+	for _, f := range *d.files {
+		known = known || f.name == ds.file
 	}
+	if !known {
+		(*d.files) = append(*d.files, docsetFile{ds.file, ds.item.Title})
+	}
+	d.itemsLock.Unlock()
+	item := ds.item
+	idx.replace(oldVersion, IndexedDocset{d.Name(), item.Title, item.Id, docsetKeywords(item.Name, item.Title), LoadAliases(d.Name(), item.Id), ds.version}, entries)
 }
 
-func (d DashRepo) IndexDocById(idx GlobalIndex, id string) {
-	var err error
+// forgetFile stops serving pages of a removed docset.
+func (d DashRepo) forgetFile(name string) {
+	d.itemsLock.Lock()
+	defer d.itemsLock.Unlock()
+	delete(*d.symbolCounts, name)
+	var files []docsetFile
+	for _, f := range *d.files {
+		if f.name != name {
+			files = append(files, f)
+		}
+	}
+	*d.files = files
+}
 
-	f, err := ioutil.TempFile("", "zealdb")
-	check(err)
+// readDocsetIndex extracts the SQLite index of the docset to temporary files
+// and reads its entries, with paths starting with pathPrefix, and the number
+// of symbols of each type.
+func readDocsetIndex(name, docsetName, pathPrefix string) ([]IndexEntry, map[string]int, error) {
+	f, err := ioutil.TempFile(TempDir(), "zealdb")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
 	fShm, err := os.Create(f.Name() + "-shm")
-	check(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(fShm.Name())
+	defer fShm.Close()
 	fWal, err := os.Create(f.Name() + "-wal")
-	check(err)
-	var docsetName, name string
-
-	q, err := GetCacheDB().Query(
-		"SELECT available_doc_id, json FROM installed_docs i INNER JOIN available_docs a ON i.available_doc_id=a.id WHERE a.id = ?",
-		id)
-	check(err)
-	var dsid []byte
-	if q.Next() {
-		var value []byte
-		var item RepoItem
-		q.Scan(&dsid, &value)
-		json.Unmarshal(value, &item)
-		name = item.Title + ".zealdocset"
-		docsetName = item.Title + ".docset"
-		q.Close()
+	if err != nil {
+		return nil, nil, err
 	}
+	defer os.Remove(fWal.Name())
+	defer fWal.Close()
 
-	check(ExtractFile(name, docsetName+"/Contents/Resources/docSet.dsidx", f))
+	if err = ExtractFile(name, docsetName+"/Contents/Resources/docSet.dsidx", f); err != nil {
+		return nil, nil, err
+	}
+	// only present in some docsets
 	ExtractFile(name, docsetName+"/Contents/Resources/docSet.dsidx-shm", fShm)
 	ExtractFile(name, docsetName+"/Contents/Resources/docSet.dsidx-wal", fWal)
-	shortName := strings.Replace(docsetName, ".docset", "", 1)
-	(*d.docsetNames) = append(*d.docsetNames, shortName)
-	(*idx.DocsetNames) = append(*idx.DocsetNames, []string{d.Name(), shortName, string(dsid)})
-	(*d.docsetDbs) = append(*d.docsetDbs, name)
 	f.Close()
 	fShm.Close()
 	fWal.Close()
 
 	db, err := sql.Open("sqlite3", f.Name())
-
-	if err == nil {
-		ImportRows(db, idx.All, idx.AllMunged, idx.Paths, idx.Docsets, idx.Types, docsetName, len(*idx.DocsetNames)-1)
-
-		curCounts := make(map[string]int)
-		dbRes, _ := db.Query("SELECT type, COUNT(*) FROM searchIndexView GROUP BY type")
-		for dbRes.Next() {
-			var tp string
-			var count int
-			dbRes.Scan(&tp, &count)
-			curCounts[MapType(tp)] += count
-		}
-		dbRes.Close()
-		(*d.symbolCounts)[strings.Replace(docsetName, ".docset", "", 1)] = curCounts
-		db.Close()
-	} else {
-		fmt.Println(err.Error())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+	entries, err := ImportRows(db, pathPrefix)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	os.Remove(f.Name())
-	os.Remove(fShm.Name())
-	os.Remove(fWal.Name())
+	counts := make(map[string]int)
+	rows, err := db.Query("SELECT type, COUNT(*) FROM searchIndexView GROUP BY type")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tp string
+		var count int
+		if err = rows.Scan(&tp, &count); err != nil {
+			return nil, nil, err
+		}
+		counts[MapType(tp)] += count
+	}
+	return entries, counts, rows.Err()
 }
 
-func ImportRows(db *sql.DB, all, allMunged, paths *[]string, docsets *[]int, types *[]string, docsetName string, docsetNum int) {
+var dashEntryRe = regexp.MustCompile("<dash_entry_.*>")
+
+func ImportRows(db *sql.DB, docsetName string) ([]IndexEntry, error) {
 	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table'")
-	check(err)
+	if err != nil {
+		return nil, err
+	}
 
 	var col string
 	var tp string
@@ -707,7 +869,10 @@ func ImportRows(db *sql.DB, all, allMunged, paths *[]string, docsets *[]int, typ
 	var fragment string
 	hasSearchIndex := false
 	for rows.Next() {
-		err = rows.Scan(&col)
+		if err = rows.Scan(&col); err != nil {
+			rows.Close()
+			return nil, err
+		}
 		if col == "searchIndex" {
 			hasSearchIndex = true
 		}
@@ -715,7 +880,7 @@ func ImportRows(db *sql.DB, all, allMunged, paths *[]string, docsets *[]int, typ
 	rows.Close()
 
 	if !hasSearchIndex {
-		db.Exec("CREATE VIEW IF NOT EXISTS searchIndexView AS" +
+		_, err = db.Exec("CREATE VIEW IF NOT EXISTS searchIndexView AS" +
 			"  SELECT" +
 			"    ztokenname AS name," +
 			"    ztypename AS type," +
@@ -729,97 +894,69 @@ func ImportRows(db *sql.DB, all, allMunged, paths *[]string, docsets *[]int, typ
 			"  INNER JOIN ztokentype" +
 			"    ON ztoken.ztokentype = ztokentype.z_pk")
 	} else {
-		db.Exec("CREATE VIEW IF NOT EXISTS searchIndexView AS" +
+		_, err = db.Exec("CREATE VIEW IF NOT EXISTS searchIndexView AS" +
 			"  SELECT" +
 			"    name, type, path, '' AS fragment" +
 			"  FROM searchIndex")
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	rows, err = db.Query("SELECT name, type, path, coalesce(fragment, '') FROM searchIndexView ORDER BY name ASC")
-	check(err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	re, err := regexp.Compile("<dash_entry_.*>")
-	check(err)
+	var entries []IndexEntry
 
 	for rows.Next() {
-		err = rows.Scan(&col, &tp, &path, &fragment)
-		check(err)
-		*all = append(*all, col)
-		*allMunged = append(*allMunged, Munge(col))
-		*docsets = append(*docsets, docsetNum)
-		*types = append(*types, MapType(tp))
+		if err = rows.Scan(&col, &tp, &path, &fragment); err != nil {
+			return nil, err
+		}
 		if fragment != "" {
 			fragment = "#" + fragment
 		}
-		path = re.ReplaceAllString(path, "");
-		fragment = re.ReplaceAllString(fragment, "");
-		*paths = append(*paths, docsetName+"/Contents/Resources/Documents/"+path+fragment)
+		path = dashEntryRe.ReplaceAllString(path, "");
+		fragment = dashEntryRe.ReplaceAllString(fragment, "");
+		entries = append(entries, IndexEntry{
+			Name:   col,
+			Munged: Munge(col),
+			Path:   docsetName + "/Contents/Resources/Documents/" + path + fragment,
+			Type:   MapType(tp),
+		})
+	}
+	return entries, rows.Err()
+}
+
+// RemoveDocset removes the installed version of the docset with the given
+// key, or all installed versions of it.
+func (d DashRepo) RemoveDocset(id string, idx *GlobalIndex) bool {
+	installed, err := d.installedDocsets(id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return false
 	}
-	rows.Close()
-}
-
-func removeFromIndex(title string, idx GlobalIndex) {
-	var num int
-	for i, name := range *idx.DocsetNames {
-		if name[0] == "com.kapeli" && name[1] == title {
-			num = i
+	removed := false
+	for _, ds := range installed {
+		if err = os.Remove(ds.path()); err != nil && !os.IsNotExist(err) {
+			continue
 		}
-	}
-	idx.Lock.Lock()
-
-	oldAll := *idx.All
-	oldAllMunged := *idx.AllMunged
-	oldDocsets := *idx.Docsets
-	oldTypes := *idx.Types
-	oldPaths := *idx.Paths
-
-	var all []string
-	var allMunged []string
-	var docsets []int
-	var types []string
-	var paths []string
-
-	for i := 0; i < len(oldAll); i++ {
-		if oldDocsets[i] != num {
-			all = append(all, oldAll[i])
-			allMunged = append(allMunged, oldAllMunged[i])
-			docsets = append(docsets, oldDocsets[i])
-			types = append(types, oldTypes[i])
-			paths = append(paths, oldPaths[i])
+		removeCachedIndex(ds.path())
+		os.Remove(fullTextPath(ds.file))
+		_, err = GetCacheDB().Exec("DELETE FROM installed_docs WHERE available_doc_id = ? AND version = ?", ds.item.Id, ds.version)
+		if err != nil {
+			fmt.Println(err.Error())
 		}
+		d.forgetFile(ds.file)
+		idx.removeVersion(ds.item.Id, ds.version)
+		removed = true
 	}
-
-	(*idx.All) = all
-	(*idx.AllMunged) = allMunged
-	(*idx.Paths) = paths
-	(*idx.Docsets) = docsets
-	(*idx.Types) = types
-	idx.Lock.Unlock()
-}
-
-func (d DashRepo) RemoveDocset(id string, idx GlobalIndex) bool {
-	q, err := GetCacheDB().Query(
-		"SELECT json FROM installed_docs i INNER JOIN available_docs a ON i.available_doc_id=a.id WHERE a.id = ?",
-		id)
-	var title string
-	if err == nil && q.Next() {
-		var value []byte
-		var item RepoItem
-		q.Scan(&value)
-		json.Unmarshal(value, &item)
-		title = item.Title
-		if os.Remove(item.Title+".zealdocset") == nil {
-			q.Close()
-			_, err := GetCacheDB().Exec("DELETE FROM installed_docs WHERE available_doc_id = ?", id)
-			if err != nil {
-				fmt.Println(err.Error())
-			}
-			removeFromIndex(title, idx)
-			return true
+	if removed {
+		if left, err := d.installedDocsets(installed[0].item.Id); err == nil && len(left) == 0 {
+			SaveAliases(d.Name(), installed[0].item.Id, nil)
 		}
 	}
-	if q != nil {
-		q.Close()
-	}
-	return false
+	return removed
 }